@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogWriter is where -access-log lines go, shared by every handler
+type accessLogWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (a *accessLogWriter) writeLine(line string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	io.WriteString(a.w, line)
+}
+
+// statusRecorder notes the status and body size of a response on its way out, passing on
+// flushing and hijacking so the handlers that rely on them still work
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int
+	hijacked bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	written, writeErr := s.ResponseWriter.Write(b)
+	s.bytes += written
+	return written, writeErr
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, canFlush := s.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, canHijack := s.ResponseWriter.(http.Hijacker)
+	if !canHijack {
+		return nil, nil, http.ErrNotSupported
+	}
+	s.hijacked = true
+	return hijacker.Hijack()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// logAccess writes a line in Apache combined log format for every request once it has been
+// answered. Responses written on a hijacked connection show - for their status and size.
+func logAccess(next http.Handler, accessLog *accessLogWriter) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: resp}
+		received := time.Now()
+		next.ServeHTTP(recorder, req)
+		status, size := "-", "-"
+		if recorder.status != 0 {
+			status = strconv.Itoa(recorder.status)
+		} else if !recorder.hijacked {
+			// net/http answers 200 for handlers that return without writing anything
+			status = "200"
+		}
+		if recorder.bytes > 0 {
+			size = strconv.Itoa(recorder.bytes)
+		}
+		user := "-"
+		if name, _, hasAuth := req.BasicAuth(); hasAuth && name != "" {
+			user = name
+		}
+		accessLog.writeLine(fmt.Sprintf("%s - %s [%s] %q %s %s %q %q\n",
+			clientIP(req), user, received.Format("02/Jan/2006:15:04:05 -0700"),
+			req.Method+" "+req.RequestURI+" "+req.Proto, status, size, orDash(req.Referer()), orDash(req.UserAgent())))
+	})
+}
+
+// clientIP is the address the request came from, or with -trust-xff the first one X-Forwarded-For names
+func clientIP(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); trustXFF && forwarded != "" {
+		first, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, splitErr := net.SplitHostPort(req.RemoteAddr)
+	if nil != splitErr {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	fresh(t)
+	var logged bytes.Buffer
+	logger := logAccess(handler(), &accessLogWriter{w: &logged})
+	req := httptest.NewRequest(http.MethodPost, "/orders?id=7", strings.NewReader("order"))
+	req.RemoteAddr = "192.0.2.10:51234"
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("Referer", "https://shop.example/cart")
+	req.Header.Set("User-Agent", `curl/8.5 "quoted"`)
+	logger.ServeHTTP(httptest.NewRecorder(), req)
+	recorded(t, 1)
+
+	line := logged.String()
+	combined := regexp.MustCompile(`^192\.0\.2\.10 - alice \[(\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4})\] "POST /orders\?id=7 HTTP/1\.1" 200 (\d+) "https://shop\.example/cart" "curl/8\.5 \\"quoted\\""\n$`)
+	match := combined.FindStringSubmatch(line)
+	if match == nil {
+		t.Fatalf("%q isn't a combined log line", line)
+	}
+	if when, parseErr := time.Parse("02/Jan/2006:15:04:05 -0700", match[1]); nil != parseErr || time.Since(when) > time.Minute {
+		t.Error("logged the time", match[1], parseErr)
+	}
+	if match[2] != "17" {
+		t.Error("logged a body of", match[2], `bytes for "/orders received\n"`)
+	}
+
+	logged.Reset()
+	get("/configDelay?statusMix=204:1")
+	bare := httptest.NewRequest(http.MethodGet, "/missing-details", nil)
+	bare.RemoteAddr = "198.51.100.4:1"
+	logger.ServeHTTP(httptest.NewRecorder(), bare)
+	recorded(t, 2)
+	// no user, no body, no referer and no user agent all show as -
+	if want := `198.51.100.4 - - [`; !strings.HasPrefix(logged.String(), want) || !strings.HasSuffix(logged.String(), `] "GET /missing-details HTTP/1.1" 204 - "-" "-"`+"\n") {
+		t.Errorf("logged %q", logged.String())
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// records are written to -db in transactions of up to this many, or whatever has queued up when
+// the flush ticker in storeCalls fires
+const dbBatchSize = 100
+
+// the columns worth querying on, and the whole record as JSON in record for everything else
+const createRequestsTable = `CREATE TABLE IF NOT EXISTS requests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	seq INTEGER NOT NULL,
+	timestamp TEXT NOT NULL,
+	method TEXT NOT NULL,
+	uri TEXT NOT NULL,
+	proto TEXT NOT NULL,
+	scheme TEXT,
+	status INTEGER NOT NULL,
+	request_id TEXT,
+	payload_size INTEGER NOT NULL,
+	payload_hash TEXT,
+	raw_hash TEXT,
+	payload TEXT,
+	rejected TEXT,
+	user_agent TEXT,
+	delay_applied_ns INTEGER NOT NULL,
+	record TEXT NOT NULL
+)`
+
+const insertRequest = `INSERT INTO requests (seq, timestamp, method, uri, proto, scheme, status, request_id,
+	payload_size, payload_hash, raw_hash, payload, rejected, user_agent, delay_applied_ns, record)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// recordDB is the durable log -db keeps in a SQLite requests table, on top of the in memory list
+// the endpoints serve. It isn't safe for concurrent use, storeCalls is its only user.
+type recordDB struct {
+	db      *sql.DB
+	pending []requestRecord
+}
+
+func openRecordDB(path string) (*recordDB, error) {
+	db, openErr := sql.Open("sqlite", path)
+	if nil != openErr {
+		return nil, openErr
+	}
+	// one connection, so every batch goes through the same SQLite handle in turn
+	db.SetMaxOpenConns(1)
+	if _, createErr := db.Exec(createRequestsTable); nil != createErr {
+		db.Close()
+		return nil, createErr
+	}
+	return &recordDB{db: db}, nil
+}
+
+// add queues call, writing out the queue once it makes a full batch
+func (r *recordDB) add(call requestRecord) error {
+	r.pending = append(r.pending, call)
+	if len(r.pending) >= dbBatchSize {
+		return r.flush()
+	}
+	return nil
+}
+
+// flush writes whatever is queued in one transaction. The queue is emptied either way, so a
+// database that keeps failing can't hold on to records without end.
+func (r *recordDB) flush() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	defer func() { r.pending = r.pending[:0] }()
+	tx, beginErr := r.db.Begin()
+	if nil != beginErr {
+		return beginErr
+	}
+	insert, prepareErr := tx.Prepare(insertRequest)
+	if nil != prepareErr {
+		tx.Rollback()
+		return prepareErr
+	}
+	defer insert.Close()
+	for _, call := range r.pending {
+		record, marshalErr := json.Marshal(call)
+		if nil != marshalErr {
+			tx.Rollback()
+			return marshalErr
+		}
+		if _, insertErr := insert.Exec(call.Seq, call.Timestamp.Format(time.RFC3339Nano), call.Method, call.Uri, call.Proto,
+			call.Scheme, call.Status, call.RequestID, call.PayloadSize, call.PayloadHash, call.RawHash, call.Payload,
+			call.Rejected, call.UserAgent, int64(call.DelayApplied), string(record)); nil != insertErr {
+			tx.Rollback()
+			return insertErr
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *recordDB) Close() error {
+	flushErr := r.flush()
+	if closeErr := r.db.Close(); nil == flushErr {
+		return closeErr
+	}
+	return flushErr
+}
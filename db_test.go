@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordDB(t *testing.T) {
+	fresh(t)
+	path := filepath.Join(t.TempDir(), "putter.db")
+	db, openErr := openRecordDB(path)
+	if nil != openErr {
+		t.Fatal(openErr)
+	}
+	set(t, &callDB, db)
+	serve(httptest.NewRequest(http.MethodPost, "/one", strings.NewReader("first")))
+	serve(withHeader("/two?x=1", "User-Agent", "db-test"))
+	recorded(t, 2)
+	// what storeCalls writes out at shutdown
+	flushed := make(chan struct{})
+	flushChan <- flushed
+	<-flushed
+	if closeErr := db.Close(); nil != closeErr {
+		t.Fatal(closeErr)
+	}
+
+	reopened, reopenErr := sql.Open("sqlite", path)
+	if nil != reopenErr {
+		t.Fatal(reopenErr)
+	}
+	defer reopened.Close()
+	rows, queryErr := reopened.Query("SELECT seq, method, uri, status, payload_size, payload_hash, user_agent, record FROM requests ORDER BY seq")
+	if nil != queryErr {
+		t.Fatal(queryErr)
+	}
+	defer rows.Close()
+	var found []requestRecord
+	for rows.Next() {
+		var row, fromJSON requestRecord
+		var record string
+		if scanErr := rows.Scan(&row.Seq, &row.Method, &row.Uri, &row.Status, &row.PayloadSize, &row.PayloadHash, &row.UserAgent, &record); nil != scanErr {
+			t.Fatal(scanErr)
+		}
+		if decodeErr := json.Unmarshal([]byte(record), &fromJSON); nil != decodeErr || fromJSON.Uri != row.Uri || fromJSON.Seq != row.Seq {
+			t.Error("record column", record, "doesn't match", row.Seq, row.Uri, decodeErr)
+		}
+		found = append(found, row)
+	}
+	if len(found) != 2 {
+		t.Fatal("expected 2 rows, got", found)
+	}
+	if one := found[0]; one.Method != http.MethodPost || one.Uri != "/one" || one.Status != 200 || one.PayloadSize != 5 || one.PayloadHash != hashOf("first") {
+		t.Error("first row is", one)
+	}
+	if two := found[1]; two.Seq != found[0].Seq+1 || two.Uri != "/two?x=1" || two.UserAgent != "db-test" {
+		t.Error("second row is", two)
+	}
+}
+
+func TestRecordDBBatches(t *testing.T) {
+	db, openErr := openRecordDB(filepath.Join(t.TempDir(), "putter.db"))
+	if nil != openErr {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	for seq := 1; seq <= dbBatchSize; seq++ {
+		if addErr := db.add(requestRecord{Seq: seq, Method: http.MethodGet, Uri: "/batched"}); nil != addErr {
+			t.Fatal(addErr)
+		}
+	}
+	// a full batch is written without waiting for a flush
+	var rows int
+	if countErr := db.db.QueryRow("SELECT COUNT(*) FROM requests").Scan(&rows); nil != countErr || rows != dbBatchSize || len(db.pending) != 0 {
+		t.Error("after a full batch there are", rows, "rows and", len(db.pending), "pending", countErr)
+	}
+}
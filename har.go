@@ -0,0 +1,143 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// The parts of HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/) needed to describe the
+// recorded calls. putter doesn't keep response details, so those are filled in as far as the
+// record allows and stubbed otherwise.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harFromCalls describes calls as a HAR log, oldest first as HAR viewers expect, with URLs on host
+func harFromCalls(calls []requestRecord, host string) harFile {
+	entries := make([]harEntry, 0, len(calls))
+	for i := len(calls) - 1; i >= 0; i-- {
+		call := calls[i]
+		query := []harNameValue{}
+		if parsed, parseErr := url.ParseRequestURI(call.Uri); nil == parseErr {
+			for name, values := range parsed.Query() {
+				for _, value := range values {
+					query = append(query, harNameValue{name, value})
+				}
+			}
+		}
+		headers := []harNameValue{}
+		for _, name := range slices.Sorted(maps.Keys(call.Headers)) {
+			for _, value := range call.Headers[name] {
+				headers = append(headers, harNameValue{name, value})
+			}
+		}
+		var postData *harPostData
+		if call.Payload != "" {
+			postData = &harPostData{MimeType: "application/octet-stream", Text: call.Payload}
+		}
+		scheme := call.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		readMillis := float64(call.ReadDuration) / float64(time.Millisecond)
+		entries = append(entries, harEntry{
+			StartedDateTime: call.Timestamp.Format(time.RFC3339Nano),
+			Time:            readMillis,
+			Request: harRequest{
+				Method:      call.Method,
+				URL:         scheme + "://" + host + call.Uri,
+				HTTPVersion: call.Proto,
+				Cookies:     []harNameValue{},
+				Headers:     headers,
+				QueryString: query,
+				PostData:    postData,
+				HeadersSize: call.HeaderBytes,
+				BodySize:    call.PayloadSize,
+			},
+			Response: harResponse{
+				Status:      call.Status,
+				StatusText:  http.StatusText(call.Status),
+				HTTPVersion: call.Proto,
+				Cookies:     []harNameValue{},
+				Headers:     []harNameValue{},
+				Content:     harContent{Size: -1, MimeType: "text/plain"},
+				HeadersSize: -1,
+				BodySize:    -1,
+			},
+			Timings: harTimings{Send: readMillis, Wait: -1, Receive: -1},
+		})
+	}
+	return harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "putter", Version: "1"},
+		Entries: entries,
+	}}
+}
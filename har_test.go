@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHAR(t *testing.T) {
+	fresh(t)
+	set(t, &storePayload, true)
+	serve(httptest.NewRequest(http.MethodGet, "/first?page=2", nil))
+	serve(httptest.NewRequest(http.MethodPost, "/second", strings.NewReader("body")))
+	recorded(t, 2)
+
+	resp := serve(httptest.NewRequest(http.MethodGet, "http://putter.test"+adminPrefix+"/recordedRequests?format=har", nil))
+	if contentType := resp.Header().Get("Content-Type"); resp.Code != 200 || contentType != "application/json" {
+		t.Fatal("the HAR export answered", resp.Code, contentType)
+	}
+	// generic JSON, so this checks what HAR readers will see rather than what harFile says
+	var har struct {
+		Log struct {
+			Version string `json:"version"`
+			Entries []struct {
+				StartedDateTime string `json:"startedDateTime"`
+				Request         struct {
+					Method      string              `json:"method"`
+					URL         string              `json:"url"`
+					QueryString []map[string]string `json:"queryString"`
+					PostData    map[string]string   `json:"postData"`
+					BodySize    int                 `json:"bodySize"`
+				} `json:"request"`
+				Response map[string]any `json:"response"`
+				Timings  map[string]any `json:"timings"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	if decodeErr := json.Unmarshal(resp.Body.Bytes(), &har); nil != decodeErr {
+		t.Fatal("the HAR export isn't JSON:", decodeErr, resp.Body)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+		t.Fatal("the HAR export has version", har.Log.Version, "and", len(har.Log.Entries), "entries")
+	}
+	first, second := har.Log.Entries[0], har.Log.Entries[1]
+	if first.Request.Method != http.MethodGet || first.Request.URL != "http://putter.test/first?page=2" || first.Request.BodySize != 0 {
+		t.Error("the oldest entry is", first.Request)
+	}
+	if len(first.Request.QueryString) != 1 || first.Request.QueryString[0]["name"] != "page" || first.Request.QueryString[0]["value"] != "2" {
+		t.Error("the query string is", first.Request.QueryString)
+	}
+	if second.Request.Method != http.MethodPost || second.Request.BodySize != 4 || second.Request.PostData["text"] != "body" {
+		t.Error("the newest entry is", second.Request)
+	}
+	for _, entry := range har.Log.Entries {
+		if _, parseErr := time.Parse(time.RFC3339Nano, entry.StartedDateTime); nil != parseErr {
+			t.Error("startedDateTime", entry.StartedDateTime, parseErr)
+		}
+		if entry.Response["status"] != 200.0 || entry.Timings == nil {
+			t.Error("the stubbed response is", entry.Response, "with timings", entry.Timings)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// rotatingFile appends to path until a write would take it past maxSize, then shifts path to
+// path.1, path.1 to path.2 and so on, dropping whatever would go past path.<backups>, and starts
+// path afresh. It isn't safe for concurrent use, storeCalls is its only writer.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	file, openErr := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if nil != openErr {
+		return openErr
+	}
+	info, statErr := file.Stat()
+	if nil != statErr {
+		file.Close()
+		return statErr
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	// a single write bigger than maxSize still goes in whole, to a file of its own
+	if r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if rotateErr := r.rotate(); nil != rotateErr {
+			return 0, rotateErr
+		}
+	}
+	written, writeErr := r.file.Write(b)
+	r.size += int64(written)
+	return written, writeErr
+}
+
+func (r *rotatingFile) rotate() error {
+	if closeErr := r.file.Close(); nil != closeErr {
+		return closeErr
+	}
+	if r.backups < 1 {
+		os.Remove(r.path)
+	} else {
+		os.Remove(r.backupPath(r.backups))
+		for n := r.backups - 1; n > 0; n-- {
+			os.Rename(r.backupPath(n), r.backupPath(n+1))
+		}
+		if renameErr := os.Rename(r.path, r.backupPath(1)); nil != renameErr {
+			return renameErr
+		}
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) backupPath(n int) string {
+	return r.path + "." + strconv.Itoa(n)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFileRotates(t *testing.T) {
+	fresh(t)
+	path := filepath.Join(t.TempDir(), "putter.log")
+	// a record's line is a little over 100 bytes, so this rolls over every few requests
+	rotating, openErr := openRotatingFile(path, 400, 2)
+	if nil != openErr {
+		t.Fatal(openErr)
+	}
+	// rotating swaps in a new file, so the one to close is whichever is current at the end
+	defer func() { rotating.file.Close() }()
+	set(t, &callLog, rotating)
+	for range 20 {
+		get("/soak")
+	}
+	calls := recorded(t, 20)
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, statErr := os.Stat(name)
+		if nil != statErr {
+			t.Fatal(statErr)
+		}
+		if info.Size() == 0 || info.Size() > 400 {
+			t.Error(name, "is", info.Size(), "bytes")
+		}
+	}
+	if _, statErr := os.Stat(path + ".3"); !os.IsNotExist(statErr) {
+		t.Error("more than 2 backups were kept:", statErr)
+	}
+	current, _ := os.ReadFile(path)
+	if !strings.HasSuffix(string(current), calls[0].String()) {
+		t.Errorf("the newest record isn't at the end of %q", current)
+	}
+	newestBackup, _ := os.ReadFile(path + ".1")
+	if !strings.HasPrefix(string(newestBackup), "#") || !strings.HasSuffix(string(newestBackup), "\n--\n") {
+		t.Errorf("%s.1 doesn't hold whole records: %q", path, newestBackup)
+	}
+}
+
+func TestLogFileOversizedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "putter.log")
+	rotating, openErr := openRotatingFile(path, 10, 0)
+	if nil != openErr {
+		t.Fatal(openErr)
+	}
+	defer func() { rotating.file.Close() }()
+	rotating.Write([]byte("small\n"))
+	rotating.Write([]byte("far bigger than ten bytes\n"))
+	rotating.Write([]byte("next\n"))
+	// with no backups, rolling over just starts afresh
+	if contents, _ := os.ReadFile(path); string(contents) != "next\n" {
+		t.Errorf("the log holds %q", contents)
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 0 {
+		t.Error("backups kept with -log-backups 0:", matches)
+	}
+}
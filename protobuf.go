@@ -0,0 +1,59 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/superflaco/putter record.proto
+
+import (
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/superflaco/putter/recordpb"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// deterministic so the same record always encodes to the same bytes
+var delimitedRecords = protodelim.MarshalOptions{MarshalOptions: proto.MarshalOptions{Deterministic: true}}
+
+// writeDelimitedRecord writes call as a varint length prefixed RequestRecord from record.proto
+func writeDelimitedRecord(w io.Writer, call requestRecord) error {
+	_, writeErr := delimitedRecords.MarshalTo(w, toProtobuf(call))
+	return writeErr
+}
+
+// toProtobuf copies the fields record.proto carries into the generated type
+func toProtobuf(call requestRecord) *recordpb.RequestRecord {
+	message := &recordpb.RequestRecord{
+		Seq:               int64(call.Seq),
+		Method:            call.Method,
+		Uri:               call.Uri,
+		Proto:             call.Proto,
+		Status:            int32(call.Status),
+		RequestId:         call.RequestID,
+		PayloadSize:       int64(call.PayloadSize),
+		PayloadHash:       call.PayloadHash,
+		RawHash:           call.RawHash,
+		Payload:           []byte(call.Payload),
+		InterArrivalNanos: int64(call.InterArrival),
+		Rejected:          call.Rejected,
+		ReadMode:          call.ReadMode,
+		HeaderBytes:       int64(call.HeaderBytes),
+		UserAgent:         call.UserAgent,
+		Scheme:            call.Scheme,
+		DelayAppliedNanos: int64(call.DelayApplied),
+		IsText:            call.IsText,
+		Entropy:           call.Entropy,
+		OriginalUri:       call.OriginalUri,
+		MatchedRule:       call.MatchedRule,
+	}
+	if !call.Timestamp.IsZero() {
+		message.TimestampUnixNano = call.Timestamp.UnixNano()
+	}
+	// sorted so the same record always lists its headers in the same order
+	for _, name := range slices.Sorted(maps.Keys(call.Headers)) {
+		for _, value := range call.Headers[name] {
+			message.Headers = append(message.Headers, &recordpb.Header{Name: name, Value: value})
+		}
+	}
+	return message
+}
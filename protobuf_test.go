@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superflaco/putter/recordpb"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// decodeRecords reads a ?format=protobuf stream back, the way a consumer built from record.proto would
+func decodeRecords(t *testing.T, stream []byte) []requestRecord {
+	t.Helper()
+	var records []requestRecord
+	reader := bufio.NewReader(bytes.NewReader(stream))
+	for {
+		var message recordpb.RequestRecord
+		if readErr := protodelim.UnmarshalFrom(reader, &message); errors.Is(readErr, io.EOF) {
+			return records
+		} else if nil != readErr {
+			t.Fatal("bad record after", len(records), "records:", readErr)
+		}
+		records = append(records, fromProtobuf(&message))
+	}
+}
+
+func fromProtobuf(message *recordpb.RequestRecord) requestRecord {
+	call := requestRecord{
+		Seq:          int(message.Seq),
+		Timestamp:    time.Unix(0, message.TimestampUnixNano),
+		Method:       message.Method,
+		Uri:          message.Uri,
+		Proto:        message.Proto,
+		Status:       int(message.Status),
+		RequestID:    message.RequestId,
+		PayloadSize:  int(message.PayloadSize),
+		PayloadHash:  message.PayloadHash,
+		RawHash:      message.RawHash,
+		Payload:      string(message.Payload),
+		InterArrival: time.Duration(message.InterArrivalNanos),
+		Rejected:     message.Rejected,
+		ReadMode:     message.ReadMode,
+		HeaderBytes:  int(message.HeaderBytes),
+		UserAgent:    message.UserAgent,
+		Scheme:       message.Scheme,
+		DelayApplied: time.Duration(message.DelayAppliedNanos),
+		IsText:       message.IsText,
+		Entropy:      message.Entropy,
+		OriginalUri:  message.OriginalUri,
+		MatchedRule:  message.MatchedRule,
+	}
+	for _, header := range message.Headers {
+		if call.Headers == nil {
+			call.Headers = http.Header{}
+		}
+		call.Headers[header.Name] = append(call.Headers[header.Name], header.Value)
+	}
+	return call
+}
+
+// inProtobuf keeps just what record.proto carries
+func inProtobuf(call requestRecord) requestRecord {
+	return requestRecord{
+		Seq: call.Seq, Method: call.Method, Uri: call.Uri, Proto: call.Proto, Status: call.Status,
+		RequestID: call.RequestID, PayloadSize: call.PayloadSize, PayloadHash: call.PayloadHash, RawHash: call.RawHash,
+		Payload: call.Payload, InterArrival: call.InterArrival, Rejected: call.Rejected, ReadMode: call.ReadMode,
+		HeaderBytes: call.HeaderBytes, UserAgent: call.UserAgent, Scheme: call.Scheme, DelayApplied: call.DelayApplied,
+		IsText: call.IsText, Entropy: call.Entropy, Headers: call.Headers, OriginalUri: call.OriginalUri, MatchedRule: call.MatchedRule,
+	}
+}
+
+func TestProtobufRecords(t *testing.T) {
+	fresh(t)
+	set(t, &storePayload, true)
+	set(t, &allowedMethods, []string{http.MethodGet, http.MethodPost})
+	req := httptest.NewRequest(http.MethodPost, "/proto?x=1", strings.NewReader("line one\nline two\n"))
+	req.Header.Add("X-Multi", "a")
+	req.Header.Add("X-Multi", "b")
+	req.Header.Set("User-Agent", "proto-test")
+	serve(req)
+	serve(httptest.NewRequest(http.MethodDelete, "/rejected", nil))
+	serve(httptest.NewRequest(http.MethodGet, "/empty", nil))
+	recorded(t, 3)
+
+	resp := serve(httptest.NewRequest(http.MethodGet, adminPrefix+"/recordedRequests?format=protobuf", nil))
+	if contentType := resp.Header().Get("Content-Type"); contentType != "application/x-protobuf; delimited=true" {
+		t.Error("the protobuf stream is", contentType)
+	}
+	decoded := decodeRecords(t, resp.Body.Bytes())
+	var fromJSON []requestRecord
+	json.Unmarshal(serve(httptest.NewRequest(http.MethodGet, adminPrefix+"/recordedRequests?format=json", nil)).Body.Bytes(), &fromJSON)
+	if len(decoded) != 3 || len(fromJSON) != 3 {
+		t.Fatal("decoded", len(decoded), "records, JSON has", len(fromJSON))
+	}
+	for i := range decoded {
+		if !decoded[i].Timestamp.Equal(fromJSON[i].Timestamp) {
+			t.Error("record", i, "has timestamp", decoded[i].Timestamp, "in protobuf and", fromJSON[i].Timestamp, "in JSON")
+		}
+		if want := inProtobuf(fromJSON[i]); !reflect.DeepEqual(inProtobuf(decoded[i]), want) {
+			t.Errorf("record %d decoded as\n%+v\nexpected\n%+v", i, inProtobuf(decoded[i]), want)
+		}
+	}
+	if post := decoded[2]; post.Payload != "line one\nline two\n" || !post.IsText || post.Entropy == 0 || len(post.Headers["X-Multi"]) != 2 {
+		t.Error("the POST decoded as", post)
+	}
+	if decoded[1].Rejected != "method not allowed" {
+		t.Error("the DELETE decoded as", decoded[1])
+	}
+}
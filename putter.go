@@ -2,168 +2,3101 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	cryptorand "crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
-type requestRecord struct {
-	Timestamp   time.Time
-	Method      string
-	Uri         string
-	PayloadSize int
-	PayloadHash string
-	Payload     string
+type requestRecord struct {
+	Seq       int       `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Method    string    `json:"method"`
+	Uri       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	// http or https, as the client saw it when -trust-xff lets X-Forwarded-Proto say
+	Scheme      string `json:"scheme,omitempty"`
+	Status      int    `json:"status"`
+	RequestID   string `json:"request_id,omitempty"`
+	RequestLine string `json:"request_line"`
+	PayloadSize int    `json:"payload_size"`
+	PayloadHash string `json:"payload_hash"`
+	// hash of the body as it came over the wire, differs from PayloadHash when -decompress undid a Content-Encoding
+	RawHash string `json:"raw_hash"`
+	// the Content-Encoding the body was sent with, and whether -decompress undid it
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Decompressed    bool   `json:"decompressed,omitempty"`
+	// with -hash-prefix, set when the body ran past the prefix so the hash covers only its start
+	PrefixHashed bool `json:"prefix_hashed,omitempty"`
+	// with -parallel-hash, set when PayloadHash is a merkleRoot rather than a plain SHA-256
+	ParallelHashed bool   `json:"parallel_hashed,omitempty"`
+	Payload        string `json:"payload,omitempty"`
+	// how long after startup the call arrived
+	Uptime time.Duration `json:"uptime"`
+	// time since the previous recorded call, zero for the first
+	InterArrival time.Duration `json:"inter_arrival"`
+	// with -compact, how many identical calls in a row this record stands for and when the last one arrived
+	Repeat   int       `json:"repeat,omitempty"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+	// why the call was turned away before its body was read, empty when it was accepted
+	Rejected       string `json:"rejected,omitempty"`
+	HeaderTooLarge bool   `json:"header_too_large,omitempty"`
+	URITooLong     bool   `json:"uri_too_long,omitempty"`
+	// with -form, the decoded fields of an urlencoded body
+	Form map[string][]string `json:"form,omitempty"`
+	// the response was cut off halfway by the truncate fault
+	Truncated bool `json:"truncated,omitempty"`
+	// the connection was reset by X-Putter-Reset instead of answered, Status is what it would have got
+	Reset bool `json:"reset,omitempty"`
+	// with -grpcweb, the length prefixed messages found in a gRPC-Web body
+	Frames []grpcWebFrame `json:"frames,omitempty"`
+	// with -schema, how a JSON body failed validation, empty when it passed or wasn't checked
+	SchemaErrors []string `json:"schema_errors,omitempty"`
+	// name of the -rules entry that answered the call
+	MatchedRule string `json:"matched_rule,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	// request headers as received, apart from the values of any -redact-headers
+	Headers http.Header `json:"headers,omitempty"`
+	// header lines sent, Host aside, and the names sent more than once, which proxies and servers
+	// can disagree about and so can be a sign of request smuggling
+	HeaderCount      int      `json:"header_count"`
+	DuplicateHeaders []string `json:"duplicate_headers,omitempty"`
+	// with -hash-headers, SHA-256 of the sorted name:value lines of Headers, Host included
+	HeaderHash string `json:"header_hash,omitempty"`
+	// approximate size of the request line and headers, to compare against the -h limit
+	HeaderBytes int `json:"header_bytes"`
+	// with -jwt, the claims of a bearer token, decoded but NOT verified so they are only as trustworthy as the client
+	JWTClaims map[string]any `json:"jwt_claims,omitempty"`
+	// segments picked out by -path-pattern, when the path matched it
+	PathParams map[string]string `json:"path_params,omitempty"`
+	// how long the body took to read and hash. Buffered reads finish before hashing starts, streamed
+	// ones hash as they go so ReadDuration is the whole loop and HashDuration the hashing part of it.
+	ReadMode     string        `json:"read_mode,omitempty"`
+	ReadDuration time.Duration `json:"read_duration"`
+	HashDuration time.Duration `json:"hash_duration"`
+	// a guess at whether the body is text, going by whether it has control characters other than
+	// whitespace, and if so how many lines it has
+	IsText    bool `json:"is_text"`
+	LineCount int  `json:"line_count,omitempty"`
+	// bits per byte, see bodyProfile.entropy
+	Entropy float64 `json:"entropy"`
+	// latency putter added on purpose: -min-latency, burn, the chance based stall and -jitter
+	DelayApplied time.Duration `json:"delay_applied"`
+	// with -raw-chunks, how a chunked body was split up on the wire
+	Chunks []chunk `json:"chunks,omitempty"`
+	// the URI as requested, when -normalize-path or a -rewrite changed Uri
+	OriginalUri string `json:"original_uri,omitempty"`
+	// what a handler panicked with, the stack goes to stderr
+	Panic string `json:"panic,omitempty"`
+	// DEBUG ONLY, with -debug-goid the id of the goroutine that handled the call. Go makes no
+	// promises about these ids, they are reused and mean nothing outside this process.
+	GoroutineID int64 `json:"debug_goroutine_id,omitempty"`
+}
+
+type grpcWebFrame struct {
+	Trailer bool   `json:"trailer"`
+	Length  int    `json:"length"`
+	Hash    string `json:"hash"`
+}
+
+func (r requestRecord) String() string {
+	notes := ""
+	if r.Uptime > 0 {
+		notes = " up " + r.Uptime.Round(time.Millisecond).String()
+	}
+	if r.Repeat > 1 {
+		notes += " x" + strconv.Itoa(r.Repeat) + " last " + r.LastSeen.Format(time.RFC3339)
+	}
+	if r.Scheme != "" {
+		notes += " scheme: " + r.Scheme
+	}
+	if r.RequestLine != "" && r.RequestLine != r.Method+" "+r.Uri+" "+r.Proto {
+		notes += " line: " + strconv.Quote(r.RequestLine)
+	}
+	if r.ContentEncoding != "" {
+		notes += " encoding: " + r.ContentEncoding
+		if r.Decompressed {
+			notes += " decompressed"
+		}
+	}
+	if r.PrefixHashed {
+		notes += " prefix hashed"
+	}
+	if r.ParallelHashed {
+		notes += " parallel hashed"
+	}
+	if r.Truncated {
+		notes += " truncated"
+	}
+	if r.Reset {
+		notes += " reset"
+	}
+	for _, frame := range r.Frames {
+		kind := "message"
+		if frame.Trailer {
+			kind = "trailer"
+		}
+		notes += " " + kind + ":" + strconv.Itoa(frame.Length) + ":" + frame.Hash
+	}
+	if len(r.SchemaErrors) > 0 {
+		notes += " schema errors: " + strings.Join(r.SchemaErrors, "; ")
+	}
+	if r.ReadMode != "" {
+		notes += " " + r.ReadMode + " read " + r.ReadDuration.String() + " hash " + r.HashDuration.String()
+	}
+	if r.PayloadSize > 0 {
+		notes += " entropy " + strconv.FormatFloat(r.Entropy, 'f', 2, 64)
+	}
+	if r.IsText {
+		notes += " text " + strconv.Itoa(r.LineCount) + " lines"
+	} else if r.PayloadSize > 0 {
+		notes += " binary"
+	}
+	if r.HeaderBytes > 0 {
+		notes += " headers " + strconv.Itoa(r.HeaderBytes) + "B"
+	}
+	if r.JWTClaims != nil {
+		claims, _ := json.Marshal(r.JWTClaims)
+		notes += " jwt: " + string(claims)
+	}
+	if r.PathParams != nil {
+		params, _ := json.Marshal(r.PathParams)
+		notes += " params: " + string(params)
+	}
+	if r.MatchedRule != "" {
+		notes += " rule: " + r.MatchedRule
+	}
+	if r.RequestID != "" {
+		notes += " id: " + r.RequestID
+	}
+	if len(r.DuplicateHeaders) > 0 {
+		notes += " duplicate headers: " + strings.Join(r.DuplicateHeaders, ",")
+	}
+	if r.HeaderHash != "" {
+		notes += " header hash: " + r.HeaderHash
+	}
+	if r.UserAgent != "" {
+		notes += " ua: " + strconv.Quote(r.UserAgent)
+	}
+	if r.Rejected != "" {
+		notes += " rejected: " + r.Rejected
+	}
+	if r.Form != nil {
+		notes += " form: " + url.Values(r.Form).Encode()
+	}
+	if r.DelayApplied > 0 {
+		notes += " delayed " + r.DelayApplied.String()
+	}
+	for _, c := range r.Chunks {
+		notes += " chunk:" + strconv.Itoa(c.Size)
+		if c.Extensions != "" {
+			notes += ";" + c.Extensions
+		}
+	}
+	if r.OriginalUri != "" {
+		notes += " original: " + r.OriginalUri
+	}
+	if r.Panic != "" {
+		notes += " panic: " + r.Panic
+	}
+	if r.GoroutineID != 0 {
+		notes += " goroutine " + strconv.FormatInt(r.GoroutineID, 10)
+	}
+	return "#" + strconv.Itoa(r.Seq) + " " + r.Timestamp.Format(time.RFC3339) + " " + r.Method + " " + r.Uri + " " + r.Proto + " " + strconv.Itoa(r.Status) + " " + strconv.Itoa(r.PayloadSize) + " " + r.PayloadHash + " +" + r.InterArrival.String() + notes + "\n\t" + r.Payload + "\n--\n"
+}
+
+// uriRewrite replaces matches of pattern in recorded URIs, from -rewrite
+type uriRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// normalizeURI collapses repeated slashes and resolves . and .. in the path of uri, keeping its
+// query and any trailing slash
+func normalizeURI(uri string) string {
+	uriPath, query, hasQuery := strings.Cut(uri, "?")
+	if uriPath == "" || uriPath == "*" {
+		return uri
+	}
+	cleaned := path.Clean(uriPath)
+	if strings.HasSuffix(uriPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if hasQuery {
+		cleaned += "?" + query
+	}
+	return cleaned
+}
+
+// rewriteURI applies every -rewrite in turn
+func rewriteURI(uri string) string {
+	for _, rewrite := range rewrites {
+		uri = rewrite.pattern.ReplaceAllString(uri, rewrite.replacement)
+	}
+	return uri
+}
+
+// rule answers requests matching its method, path and payload hash with a canned response, from the
+// -rules file. An empty method, path or hash matches any, and a path ending in * matches everything
+// starting with the rest of it. The hash is compared with PayloadHash as recorded, so it follows
+// -hash-prefix, -hash-len, -decompress and -canonical-json. A location, relative or absolute, goes
+// out as the Location header, making the rule a redirect that defaults to 302.
+type rule struct {
+	Name     string `json:"name"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Hash     string `json:"hash"`
+	Status   int    `json:"status"`
+	Body     string `json:"body"`
+	Location string `json:"location"`
+}
+
+func (r rule) matches(req *http.Request, hash string) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.Hash != "" && !strings.EqualFold(r.Hash, hash) {
+		return false
+	}
+	if prefix, isPrefix := strings.CutSuffix(r.Path, "*"); isPrefix {
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}
+	return r.Path == "" || r.Path == req.URL.Path
+}
+
+// matchRule finds the first rule that applies to req, whose payload hashed to hash
+func matchRule(req *http.Request, hash string) (rule, bool) {
+	for _, candidate := range *rules.Load() {
+		if candidate.matches(req, hash) {
+			return candidate, true
+		}
+	}
+	return rule{}, false
+}
+
+// responseTemplateData is what -response-dir files can fill in, e.g. {{.Method}} {{.Query.Get "id"}}
+// or {{.Header.Get "X-Trace"}}
+type responseTemplateData struct {
+	Method      string
+	Path        string
+	Query       url.Values
+	Header      http.Header
+	RequestID   string
+	PayloadHash string
+}
+
+// responseFile looks for the -response-dir file answering req and fills it in, saying whether there
+// was one. Paths that would lead outside the directory, through .. or a symlink, are never found.
+func responseFile(req *http.Request, requestID, payloadHash string) (string, string, bool, error) {
+	if responseRoot == nil {
+		return "", "", false, nil
+	}
+	name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if name == "" {
+		return "", "", false, nil
+	}
+	var contents []byte
+	var readErr error
+	for _, candidate := range []string{name, name + ".json"} {
+		if contents, readErr = responseRoot.ReadFile(candidate); nil == readErr {
+			name = candidate
+			break
+		}
+	}
+	if nil != readErr {
+		// missing, a directory or out of bounds, all of which leave the request to the default response
+		return "", "", false, nil
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	fileTemplate, parseErr := template.New(name).Option("missingkey=error").Parse(string(contents))
+	if nil != parseErr {
+		return "Bad response file " + name + "\n", "", true, parseErr
+	}
+	var body strings.Builder
+	if execErr := fileTemplate.Execute(&body, responseTemplateData{
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		Query:       req.URL.Query(),
+		Header:      req.Header,
+		RequestID:   requestID,
+		PayloadHash: payloadHash,
+	}); nil != execErr {
+		return "Bad response file " + name + "\n", "", true, execErr
+	}
+	return body.String(), contentType, true, nil
+}
+
+// representation is one body the default response can take, from -represent
+type representation struct {
+	mediaType string
+	body      string
+}
+
+// negotiate picks the representation the Accept header rates highest, the earlier one on a tie.
+// Each is rated by the most specific range that covers it, so text/html;q=0 rules out text/html
+// even alongside */*. A missing Accept header takes anything.
+func negotiate(accept string) (representation, bool) {
+	if strings.TrimSpace(accept) == "" {
+		accept = "*/*"
+	}
+	best, bestQuality := representation{}, 0.0
+	for _, candidate := range representations {
+		candidateType, _, _ := mime.ParseMediaType(candidate.mediaType)
+		quality, specificity := 0.0, -1
+		for _, acceptRange := range strings.Split(accept, ",") {
+			rangeType, params, parseErr := mime.ParseMediaType(acceptRange)
+			if nil != parseErr {
+				continue
+			}
+			rangeQuality := 1.0
+			if qParam, hasQ := params["q"]; hasQ {
+				if parsed, qErr := strconv.ParseFloat(qParam, 64); nil == qErr {
+					rangeQuality = parsed
+				}
+			}
+			rangeSpecificity := -1
+			if rangeType == candidateType {
+				rangeSpecificity = 2
+			} else if prefix, isWildcard := strings.CutSuffix(rangeType, "/*"); isWildcard && strings.HasPrefix(candidateType, prefix+"/") {
+				rangeSpecificity = 1
+			} else if rangeType == "*/*" {
+				rangeSpecificity = 0
+			}
+			if rangeSpecificity > specificity {
+				quality, specificity = rangeQuality, rangeSpecificity
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = candidate, quality
+		}
+	}
+	return best, bestQuality > 0
+}
+
+func representationTypes() []string {
+	types := make([]string, len(representations))
+	for i, candidate := range representations {
+		types[i] = candidate.mediaType
+	}
+	return types
+}
+
+// one response in a -response-script, played in order across requests and then from the top again
+type scriptStep struct {
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
+
+// a /waitFor caller, ready is closed once at least count calls have been recorded. Once done
+// closes the caller has stopped waiting, and storeCalls forgets about it.
+type countWaiter struct {
+	count int
+	ready chan struct{}
+	done  <-chan struct{}
+}
+
+// PayloadSink receives a copy of each request body as it is read, e.g. to keep bodies somewhere
+// other than memory. NewWriter is called before any of the body is read, so the record only has
+// the request details and none of the payload fields filled in.
+type PayloadSink interface {
+	NewWriter(record requestRecord) io.WriteCloser
+}
+
+// payloadSinks are the sinks -sink can pick from, each made from the part of the flag after the name
+var payloadSinks = map[string]func(arg string) (PayloadSink, error){
+	"file": newFileSink,
+}
+
+// registerPayloadSink makes a sink available to -sink under name
+func registerPayloadSink(name string, newSink func(arg string) (PayloadSink, error)) {
+	payloadSinks[name] = newSink
+}
+
+type nopSink struct{}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (nopSink) NewWriter(requestRecord) io.WriteCloser {
+	return nopWriteCloser{io.Discard}
+}
+
+// fileSink writes every body to its own file in dir, named after the request ID and never overwritten
+type fileSink struct {
+	dir string
+}
+
+func newFileSink(dir string) (PayloadSink, error) {
+	if dir == "" {
+		return nil, errors.New("file sink needs a directory, as in file:/some/dir")
+	}
+	return fileSink{dir}, os.MkdirAll(dir, 0755)
+}
+
+func (f fileSink) NewWriter(record requestRecord) io.WriteCloser {
+	// clients reuse their request ID when they retry, so a taken name gets a numbered suffix
+	// rather than losing the earlier body
+	name := url.PathEscape(record.RequestID)
+	for attempt := 0; ; attempt++ {
+		path := filepath.Join(f.dir, name+".body")
+		if attempt > 0 {
+			path = filepath.Join(f.dir, name+"."+strconv.Itoa(attempt)+".body")
+		}
+		file, createErr := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if nil == createErr {
+			return file
+		}
+		if !errors.Is(createErr, fs.ErrExist) {
+			fmt.Fprintln(os.Stderr, "sink:", createErr)
+			return nopWriteCloser{io.Discard}
+		}
+	}
+}
+
+// lockedSource lets handlers share one seeded source, which on its own isn't safe for concurrent use
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
+
+// stringList collects every use of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var maxHandshakes, rps, readyGoroutineThreshold, parallelHash int
+var requestLimiter rateLimiter
+var port, callCount, headerLimit, goroutinelimit, respSize, maxURI, hashPrefix, maxConns, hashLen, jitter int
+var maxRequests, bufferUnder int64
+var requiredHeaders, rewriteSpecs, representationSpecs stringList
+var requiredHeaderStatus int
+var decompress, hideErrors, decodeJWT, canonicalJSON, recoverPanics, serveEvents, h2c, trustXFF, echoBody, rawChunks, normalizePath, hashHeaders, respTrailerHash, debugGoid bool
+var bufferRequest, storePayload, echoConnection, noKeepAlive, allowHeaderFaults, compact, rejectExpect, recordForm, rawRequestLine, grpcWeb bool
+var recordedCalls []requestRecord
+var callChan chan requestRecord
+var clearChan chan chan int
+var snapshotChan chan chan []requestRecord
+var waitChan chan countWaiter
+var flushChan chan chan struct{}
+var sampleRate = 1.0
+
+// ?respSize= comes from the client, so it can't be allowed to ask for a terabyte
+var maxRespSize = 64 << 20
+
+// swapped whole by configDelay and reset-all while handlers are reading it, configLock keeps two
+// changes from overwriting each other
+var currentFaults = newPointer(defaultFaults())
+var configLock sync.Mutex
+var random *rand.Rand
+var seed int64
+var retention, minLatency, warmup, readTimeout, writeTimeout, idleTimeout, holdTimeout time.Duration
+var maxDelay = time.Minute
+var startTime time.Time
+var redactHeadersSpec, certFile, keyFile, accessLogFile, baselineFile, mirrorHeader string
+
+// with -baseline, the payload hashes expected to be recorded
+var baseline []string
+var trickleSpec, responseScriptFile, sinkSpec, schemaFile, rulesFile, allowMethodsSpec, pathPattern, mirrorURL, logFile, responseDir string
+
+// with -response-dir, opened as a root so request paths can't reach outside it
+var responseRoot *os.Root
+var logMaxSize int64
+var logBackups int
+
+// with -sse, where new records go out to /events subscribers
+var feed callFeed
+
+// with -log-file, where every new record gets appended
+var callLog *rotatingFile
+
+// with -db, where every new record gets inserted
+var callDB *recordDB
+var dbFile string
+var allowedMethods, redactedHeaders []string
+var rewrites []uriRewrite
+var representations []representation
+var requestSchema *jsonSchema
+var payloadSink PayloadSink = nopSink{}
+
+// swapped whole when SIGHUP reloads them, so a handler sees either the old set or the new one
+var rules = newPointer([]rule{})
+var responseScript = newPointer([]scriptStep{})
+var scriptCount atomic.Int64
+var trickleBytes int
+var trickleInterval time.Duration
+
+// sends -mirror copies, with a timeout so a stuck peer can't hold a sender forever
+var mirrorClient = &http.Client{Timeout: 10 * time.Second}
+
+// where handlers leave -mirror copies for a fixed few senders
+var mirrors = &mirrorQueue{size: 1000, senders: 4}
+
+// closed to ask main to shut the server down gracefully
+var shutdownChan = make(chan struct{})
+var shutdownOnce sync.Once
+
+// holds responses back for configDelay?holdUntil=N
+var holds holdBarrier
+
+// path everything putter answers itself is served under, rather than recorded
+const adminPrefix = "/__putter"
+
+// rootAdminPaths are the endpoints that were served from the root before adminPrefix, and still are
+var rootAdminPaths = []string{"/configDelay", "/recordedRequests", "/reset-all", "/readyz", "/stats", "/stats/paths", "/stats/latency", "/events", "/diff", "/compare", "/waitFor"}
+
+// isRootAdminPath matches rootAdminPaths exactly, plus the /recordedRequests/<seq> and
+// /replay/<hash> lookups, so lookalikes such as /api/configDelayed are still recorded
+func isRootAdminPath(urlPath string) bool {
+	return slices.Contains(rootAdminPaths, urlPath) || strings.HasPrefix(urlPath, "/recordedRequests/") || strings.HasPrefix(urlPath, "/replay/")
+}
+
+// DelayApplied of recent requests, for /stats/latency
+var delaySamples = &reservoir{size: 1024}
+
+// requests that made it to the recording branch, for faults that depend on how many came before
+var servedCount atomic.Int64
+
+// requests served but left unrecorded by -sample-rate
+var skippedCount atomic.Int64
+
+// reused between requests to keep allocations down under load, never retained by a record.
+// Buffers that grew past maxPooledBuffer are left to the GC rather than pinned for reuse.
+const maxPooledBuffer = 1 << 20
+
+var payloadBufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+var readBufPool = sync.Pool{New: func() any {
+	buf := make([]byte, 0x8000)
+	return &buf
+}}
+
+func init() {
+	flag.IntVar(&port, "p", 7758, "Listen Port")
+	flag.IntVar(&callCount, "c", 100, "Count of Calls to Record")
+	flag.IntVar(&headerLimit, "h", 1, "Header Size Limit in MB")
+	flag.BoolVar(&bufferRequest, "b", false, "Fully Buffer Input Before Hashing")
+	flag.IntVar(&goroutinelimit, "g", 0, "Go Routine Limit")
+	flag.BoolVar(&storePayload, "s", false, "Store Payload in addition to hashing it")
+	flag.BoolVar(&echoConnection, "echo-connection", false, "Echo Connection: keep-alive back to HTTP/1.0 clients that ask for it, sending a Content-Length so even trickled or large Bodies keep the Connection open")
+	flag.BoolVar(&allowHeaderFaults, "allow-header-faults", false, "Let X-Putter-Delay, X-Putter-Status, X-Putter-Reset and X-Putter-Panic request headers override faults per request")
+	flag.BoolVar(&compact, "compact", false, "Collapse consecutive identical calls into one record with a repeat count")
+	flag.BoolVar(&rejectExpect, "reject-expect", false, "Answer Expect: 100-continue with 417 instead of reading the body")
+	flag.DurationVar(&retention, "retention", 0, "Evict Calls older than this instead of keeping only the latest -c Calls")
+	flag.BoolVar(&recordForm, "form", false, "Buffer urlencoded form bodies and record their decoded fields")
+	flag.IntVar(&maxURI, "max-uri", 0, "Answer 414 for Request URIs longer than this many Bytes, 0 for unlimited")
+	flag.StringVar(&trickleSpec, "trickle", "", "Write Response Bodies in <bytes>,<interval> chunks, flushing and pausing between them")
+	flag.BoolVar(&rawRequestLine, "raw", false, "Record the Request Line exactly as read off the connection, for the first Request on each connection")
+	flag.StringVar(&responseScriptFile, "response-script", "", "JSON file of {\"status\", \"body\"} Responses to cycle through, one per Request")
+	flag.IntVar(&hashPrefix, "hash-prefix", 0, "Hash only the first this many Bytes of each Payload, 0 hashes all of it")
+	flag.BoolVar(&grpcWeb, "grpcweb", false, "Buffer gRPC-Web bodies and record each framed message")
+	flag.BoolVar(&noKeepAlive, "no-keepalive", false, "Close every Connection after its Response")
+	flag.StringVar(&sinkSpec, "sink", "", "Copy each Payload to a sink as it is read, e.g. file:<dir>")
+	flag.DurationVar(&minLatency, "min-latency", 0, "Wait at least this long before every Response, chance based delays come on top")
+	flag.StringVar(&schemaFile, "schema", "", "JSON Schema file to validate JSON Payloads against, answering 422 when they fail")
+	flag.Var(&requiredHeaders, "require-header", "Reject Requests missing this Header, repeat for more Headers")
+	flag.IntVar(&requiredHeaderStatus, "require-header-status", 400, "Status for Requests missing a -require-header")
+	flag.Int64Var(&seed, "seed", 0, "Seed for the fault injection randomness so runs can be reproduced, 0 seeds from the clock")
+	flag.BoolVar(&decompress, "decompress", false, "Undo gzip, deflate, br and zstd Content-Encoding before hashing, keeping the on the wire hash as RawHash")
+	flag.IntVar(&maxConns, "max-conns", 0, "Accept at most this many simultaneous Connections, leaving the rest queued, 0 for unlimited")
+	// shorter hashes collide sooner, with 8 bytes a collision becomes likely around 4 billion distinct payloads
+	flag.IntVar(&hashLen, "hash-len", 0, "Keep only the first this many Bytes of each SHA-256 digest, 0 keeps all 32")
+	flag.BoolVar(&hideErrors, "hide-errors", false, "Tell clients only 'internal error' when reading their Request fails, the details still go to stderr")
+	flag.StringVar(&rulesFile, "rules", "", "JSON file of {\"name\", \"method\", \"path\", \"hash\", \"status\", \"body\", \"location\"} Rules, the first matching one answers the Request")
+	flag.DurationVar(&warmup, "warmup", 0, "Inject no faults for this long after startup")
+	flag.Int64Var(&maxRequests, "max-requests", 0, "Shut down gracefully after this many Requests have been answered, 0 for never")
+	flag.StringVar(&allowMethodsSpec, "allow-methods", "", "Comma separated Methods to accept, others get 405, empty accepts all")
+	flag.BoolVar(&decodeJWT, "jwt", false, "Record the claims of Bearer JWTs, without verifying their signatures")
+	flag.IntVar(&jitter, "jitter", 0, "Stall every Response a further random 0 to this many ms, on top of any delay")
+	flag.StringVar(&pathPattern, "path-pattern", "", "Path like /users/{id}/orders/{orderId} whose {} segments get recorded for matching Requests")
+	flag.BoolVar(&canonicalJSON, "canonical-json", false, "Buffer JSON Payloads and hash them with sorted keys and no whitespace so equivalent documents hash the same")
+	flag.BoolVar(&recoverPanics, "recover", true, "Record and answer 500 for Requests whose handler panics, instead of dropping the Connection")
+	flag.StringVar(&mirrorURL, "mirror", "", "Buffer Payloads and POST a copy of each recorded Request to this base URL, e.g. another putter, without waiting for it")
+	flag.IntVar(&mirrors.size, "mirror-queue", mirrors.size, "Copies waiting for -mirror to send them, past which more are dropped and logged")
+	// all three default to 0, which leaves net/http waiting as long as it takes
+	flag.DurationVar(&readTimeout, "read-timeout", 0, "Drop Connections whose Request, Body included, takes longer than this to read, 0 for unlimited")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "Drop Connections whose Response isn't written this long after the Request was read, 0 for unlimited")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "Close keep-alive Connections idle for this long, 0 falls back to -read-timeout and then unlimited")
+	flag.StringVar(&logFile, "log-file", "", "Append every recorded Request to this file, rolling it over by -log-max-size")
+	flag.Int64Var(&logMaxSize, "log-max-size", 100<<20, "Roll -log-file over to <file>.1 once it would grow past this many Bytes")
+	flag.IntVar(&logBackups, "log-backups", 3, "Rolled over -log-file copies to keep, <file>.1 being the newest")
+	flag.BoolVar(&serveEvents, "sse", false, "Stream each newly recorded Request as a server-sent event from "+adminPrefix+"/events")
+	flag.Var(&rewriteSpecs, "rewrite", "<regex>=<replacement> applied to recorded URIs, e.g. to turn volatile IDs into placeholders, repeat for more, spell = in the regex as \\x3d")
+	flag.BoolVar(&h2c, "h2c", false, "Serve cleartext HTTP/2 to clients that start with the connection preface, alongside HTTP/1.x")
+	flag.BoolVar(&trustXFF, "trust-xff", false, "Believe X-Forwarded-* Headers, for running behind a proxy that sets them")
+	flag.Int64Var(&bufferUnder, "buffer-under", 0, "Buffer, and with -s store, only Payloads with a Content-Length under this many Bytes and stream the rest, 0 leaves it to -b and -s")
+	// credentials would otherwise sit in every output, /events included, for anyone who can reach putter
+	flag.StringVar(&redactHeadersSpec, "redact-headers", "Authorization,Cookie,Proxy-Authorization", "Comma separated Headers whose values are recorded as [REDACTED], empty to record every Header as sent")
+	flag.BoolVar(&echoBody, "echo", false, "Buffer Payloads and send each one back as the Response Body with its Content-Type, after any -decompress")
+	flag.StringVar(&certFile, "cert", "", "Serve HTTPS with this PEM Certificate, along with -key")
+	flag.StringVar(&keyFile, "key", "", "PEM Private Key for -cert")
+	flag.IntVar(&maxHandshakes, "max-handshakes", 0, "With -cert, run at most this many TLS Handshakes at once and queue the rest, 0 for unlimited")
+	flag.BoolVar(&rawChunks, "raw-chunks", false, "Take over the Connection of chunked Requests to record each chunk's size and extensions, answering without rules or faults")
+	flag.StringVar(&accessLogFile, "access-log", "", "Append an Apache combined log format line for every Request to this file, - for stdout")
+	flag.BoolVar(&normalizePath, "normalize-path", false, "Collapse duplicate slashes and resolve . and .. in recorded URIs, keeping the original")
+	flag.BoolVar(&hashHeaders, "hash-headers", false, "Record a SHA-256 of each Request's sorted Headers, to spot when a client's Headers change")
+	flag.Var(&representationSpecs, "represent", "<media type>=<body> to answer with when the Accept Header allows it, repeat for more, 406 when none is acceptable")
+	flag.StringVar(&baselineFile, "baseline", "", "File of expected Payload Hashes, one per line, for "+adminPrefix+"/diff to compare the recorded Requests against")
+	flag.DurationVar(&maxDelay, "max-delay", maxDelay, "Cap on the delay injected into any one Response, however it adds up, 0 for no cap")
+	flag.IntVar(&rps, "rps", 0, "Answer 429 with X-RateLimit Headers to Requests past this many per second, 0 for unlimited")
+	flag.IntVar(&readyGoroutineThreshold, "ready-goroutine-threshold", 0, "Answer "+adminPrefix+"/readyz with 503 while more than this many Go Routines are running, 0 to always be ready")
+	flag.IntVar(&parallelHash, "parallel-hash", 0, "Hash buffered Payloads over this many Bytes in parallel 1MB chunks, giving a non-standard Merkle root instead of their SHA-256, 0 never does")
+	flag.StringVar(&mirrorHeader, "mirror-header", "", "Add a <name>: <value> line with this Request Header's value, empty when absent, to every Response Body")
+	flag.DurationVar(&holdTimeout, "hold-timeout", 30*time.Second, "Longest a Response waits for the rest of its configDelay?holdUntil batch before going out alone, 0 to wait for as long as it takes")
+	flag.BoolVar(&respTrailerHash, "resp-trailer-hash", false, "Declare an X-Body-Hash Trailer and send the SHA-256 of the Response Body in it")
+	flag.Float64Var(&sampleRate, "sample-rate", sampleRate, "Record only this fraction, 0 to 1, of the Requests served, picked at random. Rejected Requests are always recorded.")
+	flag.BoolVar(&debugGoid, "debug-goid", false, "Debugging aid only: record the id of the goroutine that handled each Request, parsed from its stack trace")
+	flag.StringVar(&responseDir, "response-dir", "", "Answer a Request for /a/b with the file <dir>/a/b, or failing that <dir>/a/b.json, filled in as a Go text/template, see responseTemplateData")
+	flag.StringVar(&dbFile, "db", "", "Also insert every recorded Request into the requests table of this SQLite database, a second or so behind")
+	flag.IntVar(&respSize, "resp-size", 0, "Pad Response Body with filler up to this many Bytes")
+	flag.IntVar(&maxRespSize, "max-resp-size", maxRespSize, "Cap on the ?respSize= a Request can ask for, -resp-size itself is never capped")
+}
+
+func main() {
+	flag.Parse()
+	startTime = time.Now()
+	// again, now that -g has been parsed
+	currentFaults = newPointer(defaultFaults())
+	if sampleRate < 0 || sampleRate > 1 {
+		log.Fatalln("Invalid -sample-rate", sampleRate, "must be between 0 and 1")
+	}
+	if trickleSpec != "" {
+		chunkParam, intervalParam, _ := strings.Cut(trickleSpec, ",")
+		var trickleErr error
+		if trickleBytes, trickleErr = strconv.Atoi(chunkParam); nil == trickleErr && trickleBytes < 1 {
+			trickleErr = errors.New("chunk size must be positive")
+		}
+		if nil == trickleErr {
+			trickleInterval, trickleErr = time.ParseDuration(intervalParam)
+		}
+		if nil != trickleErr {
+			log.Fatalln("Invalid -trickle", trickleSpec, trickleErr)
+		}
+	}
+	for _, spec := range rewriteSpecs {
+		patternParam, replacement, found := strings.Cut(spec, "=")
+		pattern, patternErr := regexp.Compile(patternParam)
+		if !found || nil != patternErr {
+			log.Fatalln("Invalid -rewrite", spec, patternErr)
+		}
+		rewrites = append(rewrites, uriRewrite{pattern, replacement})
+	}
+	for _, name := range strings.Split(redactHeadersSpec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			redactedHeaders = append(redactedHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+	for _, spec := range representationSpecs {
+		mediaType, body, found := strings.Cut(spec, "=")
+		if parsedType, _, parseErr := mime.ParseMediaType(mediaType); !found || nil != parseErr || !strings.Contains(parsedType, "/") {
+			log.Fatalln("Invalid -represent", spec, parseErr)
+		}
+		representations = append(representations, representation{mediaType: mediaType, body: body})
+	}
+	if !validStatus(requiredHeaderStatus) {
+		log.Fatalln("Invalid -require-header-status", requiredHeaderStatus)
+	}
+	for _, method := range strings.Split(allowMethodsSpec, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			allowedMethods = append(allowedMethods, method)
+		}
+	}
+	if baselineFile != "" {
+		baselineText, baselineErr := os.ReadFile(baselineFile)
+		if nil != baselineErr {
+			log.Fatalln("Invalid -baseline", baselineFile, baselineErr)
+		}
+		for _, line := range strings.Split(string(baselineText), "\n") {
+			// blank lines and # comments are allowed so baselines can be annotated
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				baseline = append(baseline, strings.ToLower(line))
+			}
+		}
+	}
+	if responseDir != "" {
+		var rootErr error
+		if responseRoot, rootErr = os.OpenRoot(responseDir); nil != rootErr {
+			log.Fatalln("Invalid -response-dir", responseDir, rootErr)
+		}
+	}
+	if rulesFile != "" {
+		if rulesErr := loadRules(); nil != rulesErr {
+			log.Fatalln("Invalid -rules", rulesFile, rulesErr)
+		}
+	}
+	if responseScriptFile != "" {
+		if scriptErr := loadResponseScript(); nil != scriptErr {
+			log.Fatalln("Invalid -response-script", responseScriptFile, scriptErr)
+		}
+	}
+	// subscribed before serving, as an unhandled SIGHUP would end putter rather than reload it
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go reloadOnHangup(hangups)
+	if sinkSpec != "" {
+		sinkName, sinkArg, _ := strings.Cut(sinkSpec, ":")
+		newSink, known := payloadSinks[sinkName]
+		if !known {
+			log.Fatalln("Unknown -sink", sinkName)
+		}
+		var sinkErr error
+		if payloadSink, sinkErr = newSink(sinkArg); nil != sinkErr {
+			log.Fatalln("Invalid -sink", sinkSpec, sinkErr)
+		}
+	}
+	if schemaFile != "" {
+		var schemaErr error
+		if requestSchema, schemaErr = loadSchema(schemaFile); nil != schemaErr {
+			log.Fatalln("Invalid -schema", schemaFile, schemaErr)
+		}
+	}
+	if mirrorURL != "" {
+		if parsed, parseErr := url.Parse(mirrorURL); nil != parseErr || parsed.Host == "" {
+			log.Fatalln("Invalid -mirror", mirrorURL, parseErr)
+		}
+		mirrorURL = strings.TrimSuffix(mirrorURL, "/")
+		if mirrors.size < 0 {
+			log.Fatalln("Invalid -mirror-queue", mirrors.size)
+		}
+	}
+	if logFile != "" {
+		var logErr error
+		if callLog, logErr = openRotatingFile(logFile, logMaxSize, logBackups); nil != logErr {
+			log.Fatalln("Invalid -log-file", logFile, logErr)
+		}
+	}
+	if dbFile != "" {
+		var dbErr error
+		if callDB, dbErr = openRecordDB(dbFile); nil != dbErr {
+			log.Fatalln("Invalid -db", dbFile, dbErr)
+		}
+	}
+	callChan = make(chan requestRecord, callCount)
+	clearChan = make(chan chan int)
+	snapshotChan = make(chan chan []requestRecord)
+	waitChan = make(chan countWaiter)
+	flushChan = make(chan chan struct{})
+	recordedCalls = make([]requestRecord, 0, callCount)
+	go storeCalls(callChan, clearChan, snapshotChan, waitChan, flushChan)
+	if seed == 0 {
+		// don't really care much about the seed, just avoiding using the default of 1
+		seed = time.Now().UnixNano()
+	}
+	log.Println("Random seed:", seed)
+	randSrc := rand.NewSource(seed)
+	random = rand.New(&lockedSource{src: randSrc.(rand.Source64)})
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: limitHeaders(http.HandlerFunc(recordRequest))}
+	if recoverPanics {
+		server.Handler = recoverPanic(server.Handler)
+	}
+	if accessLogFile == "-" {
+		server.Handler = logAccess(server.Handler, &accessLogWriter{w: os.Stdout})
+	} else if accessLogFile != "" {
+		accessLog, openErr := os.OpenFile(accessLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if nil != openErr {
+			log.Fatalln("Invalid -access-log", accessLogFile, openErr)
+		}
+		server.Handler = logAccess(server.Handler, &accessLogWriter{w: accessLog})
+	}
+	// let the server accept headers past the limit so limitHeaders gets to record them, it still cuts off anything far beyond
+	server.MaxHeaderBytes = 2 * http.DefaultMaxHeaderBytes * headerLimit
+	server.SetKeepAlivesEnabled(!noKeepAlive)
+	server.ReadTimeout, server.WriteTimeout, server.IdleTimeout = readTimeout, writeTimeout, idleTimeout
+	if (certFile == "") != (keyFile == "") {
+		log.Fatalln("Invalid -cert and -key, TLS needs both")
+	}
+	if maxHandshakes > 0 {
+		if certFile == "" {
+			log.Fatalln("Invalid -max-handshakes, it only applies with -cert and -key")
+		}
+		server.TLSConfig = &tls.Config{}
+		limitHandshakes(server.TLSConfig, maxHandshakes)
+	}
+	if h2c {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	listener, listenErr := net.Listen("tcp", server.Addr)
+	if nil != listenErr {
+		log.Fatalln(listenErr)
+	}
+	if maxConns > 0 {
+		listener = newLimitListener(listener, maxConns)
+	}
+	if rawRequestLine {
+		listener = rawLineListener{listener}
+		server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, rawLineConnKey{}, conn)
+		}
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		<-shutdownChan
+		// lets in flight requests, including the one that asked for this, finish first
+		server.Shutdown(context.Background())
+		close(shutdownDone)
+	}()
+	var serveErr error
+	if certFile != "" {
+		serveErr = server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		serveErr = server.Serve(listener)
+	}
+	if errors.Is(serveErr, http.ErrServerClosed) {
+		<-shutdownDone
+		// every handler is done, so once storeCalls has caught up nothing more is coming
+		flushed := make(chan struct{})
+		flushChan <- flushed
+		<-flushed
+		if nil != callDB {
+			if closeErr := callDB.Close(); nil != closeErr {
+				log.Println("-db", dbFile, closeErr)
+			}
+		}
+	}
+	log.Println(serveErr)
+}
+
+func newPointer[T any](value T) *atomic.Pointer[T] {
+	var pointer atomic.Pointer[T]
+	pointer.Store(&value)
+	return &pointer
+}
+
+// loadRules reads -rules, leaving the current rules alone if the file doesn't parse
+func loadRules() error {
+	rulesJSON, rulesErr := os.ReadFile(rulesFile)
+	if nil != rulesErr {
+		return rulesErr
+	}
+	var loaded []rule
+	if rulesErr = json.Unmarshal(rulesJSON, &loaded); nil != rulesErr {
+		return rulesErr
+	}
+	for i := range loaded {
+		if loaded[i].Status == 0 && loaded[i].Location != "" {
+			loaded[i].Status = 302
+		} else if loaded[i].Status == 0 {
+			loaded[i].Status = 200
+		} else if !validStatus(loaded[i].Status) {
+			return fmt.Errorf("rule %d has invalid status %d", i, loaded[i].Status)
+		}
+	}
+	rules.Store(&loaded)
+	return nil
+}
+
+// loadResponseScript reads -response-script, leaving the current script alone if the file doesn't parse
+func loadResponseScript() error {
+	scriptJSON, scriptErr := os.ReadFile(responseScriptFile)
+	if nil != scriptErr {
+		return scriptErr
+	}
+	var loaded []scriptStep
+	if scriptErr = json.Unmarshal(scriptJSON, &loaded); nil != scriptErr {
+		return scriptErr
+	}
+	if len(loaded) == 0 {
+		return errors.New("no steps")
+	}
+	for i := range loaded {
+		if loaded[i].Status == 0 {
+			loaded[i].Status = 200
+		} else if !validStatus(loaded[i].Status) {
+			return fmt.Errorf("step %d has invalid status %d", i, loaded[i].Status)
+		}
+	}
+	responseScript.Store(&loaded)
+	return nil
+}
+
+// reloadOnHangup rereads -rules and -response-script on every SIGHUP from hangups, logging files
+// that don't parse and carrying on with what was loaded before
+func reloadOnHangup(hangups <-chan os.Signal) {
+	for range hangups {
+		if rulesFile != "" {
+			if rulesErr := loadRules(); nil != rulesErr {
+				log.Println("Keeping the old -rules, reloading", rulesFile, "failed:", rulesErr)
+			} else {
+				log.Println("Reloaded -rules", rulesFile)
+			}
+		}
+		if responseScriptFile != "" {
+			if scriptErr := loadResponseScript(); nil != scriptErr {
+				log.Println("Keeping the old -response-script, reloading", responseScriptFile, "failed:", scriptErr)
+			} else {
+				log.Println("Reloaded -response-script", responseScriptFile)
+			}
+		}
+	}
+}
+
+func storeCalls(c chan requestRecord, clear chan chan int, snapshot chan chan []requestRecord, wait chan countWaiter, flush chan chan struct{}) {
+	swapBuf := make([]requestRecord, 0, callCount)
+	var lastTimestamp time.Time
+	var seq, total int
+	var waiters []countWaiter
+	// flush requests wait for the calls already queued, which select would otherwise take in any order
+	var flushes []chan struct{}
+	var flushDB <-chan time.Time
+	if nil != callDB {
+		flushTicker := time.NewTicker(time.Second)
+		defer flushTicker.Stop()
+		flushDB = flushTicker.C
+	}
+	// a nil channel never fires, so without retention the expiry case is simply never taken
+	var expire <-chan time.Time
+	if retention > 0 {
+		expiryTicker := time.NewTicker(min(retention, time.Second))
+		defer expiryTicker.Stop()
+		expire = expiryTicker.C
+	}
+	for {
+		if len(flushes) > 0 && len(c) == 0 {
+			if nil != callDB {
+				if dbErr := callDB.flush(); nil != dbErr {
+					fmt.Fprintln(os.Stderr, "db:", dbErr)
+				}
+			}
+			for _, flushed := range flushes {
+				close(flushed)
+			}
+			flushes = nil
+		}
+		select {
+		case call := <-c:
+			// rewritten before comparing with the previous call so -compact sees through volatile IDs
+			rewritten := call.Uri
+			if normalizePath {
+				rewritten = normalizeURI(rewritten)
+			}
+			if rewritten = rewriteURI(rewritten); rewritten != call.Uri {
+				call.OriginalUri, call.Uri = call.Uri, rewritten
+			}
+			total++
+			waiters = releaseWaiters(waiters, total)
+			call.Uptime = call.Timestamp.Sub(startTime)
+			// calls arrive here one at a time so the gap to the previous one is well defined
+			if !lastTimestamp.IsZero() {
+				call.InterArrival = call.Timestamp.Sub(lastTimestamp)
+			}
+			lastTimestamp = call.Timestamp
+			if compact {
+				if len(recordedCalls) > 0 && sameCall(recordedCalls[0], call) {
+					recordedCalls[0].Repeat++
+					recordedCalls[0].LastSeen = call.Timestamp
+					continue
+				}
+				call.Repeat = 1
+				call.LastSeen = call.Timestamp
+			}
+			seq++
+			call.Seq = seq
+			if nil != callLog {
+				if _, logErr := io.WriteString(callLog, call.String()); nil != logErr {
+					fmt.Fprintln(os.Stderr, "log file:", logErr)
+				}
+			}
+			if serveEvents {
+				feed.publish(call)
+			}
+			if nil != callDB {
+				if dbErr := callDB.add(call); nil != dbErr {
+					fmt.Fprintln(os.Stderr, "db:", dbErr)
+				}
+			}
+			// clear this buffer for filling without reallocating and add the newest call
+			swapBuf = append(swapBuf, call)
+			// get existing calls
+			existingCalls := recordedCalls
+			if retention == 0 && callCount > 0 && len(existingCalls) >= callCount {
+				// drop earliest call from the end of the list
+				existingCalls = existingCalls[:callCount-1]
+			}
+			recordedCalls = append(swapBuf, existingCalls...)
+			// set swapBuf to the emptied existing buffer so it can start fresh next time without reallocating
+			swapBuf = existingCalls[:0]
+		case cleared := <-clear:
+			// report how many calls are being dropped, then empty the list in place
+			cleared <- len(recordedCalls)
+			recordedCalls = recordedCalls[:0]
+			lastTimestamp = time.Time{}
+			total = 0
+		case now := <-expire:
+			recordedCalls = expireCalls(recordedCalls, now.Add(-retention))
+		case <-flushDB:
+			if dbErr := callDB.flush(); nil != dbErr {
+				fmt.Fprintln(os.Stderr, "db:", dbErr)
+			}
+		case flushed := <-flush:
+			flushes = append(flushes, flushed)
+		case waiter := <-wait:
+			waiters = releaseWaiters(append(waiters, waiter), total)
+		case copyTo := <-snapshot:
+			// hand out a copy since both buffers get reused as calls come in
+			calls := make([]requestRecord, len(recordedCalls))
+			copy(calls, recordedCalls)
+			copyTo <- calls
+		}
+	}
+}
+
+// callFeed hands every new record to whoever is subscribed, for /events. A subscriber that falls
+// behind misses records rather than holding up storeCalls.
+type callFeed struct {
+	lock        sync.Mutex
+	subscribers map[chan requestRecord]struct{}
+}
+
+func (f *callFeed) subscribe() chan requestRecord {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.subscribers == nil {
+		f.subscribers = make(map[chan requestRecord]struct{})
+	}
+	calls := make(chan requestRecord, 64)
+	f.subscribers[calls] = struct{}{}
+	return calls
+}
+
+func (f *callFeed) unsubscribe(calls chan requestRecord) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.subscribers, calls)
+}
+
+func (f *callFeed) publish(call requestRecord) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for calls := range f.subscribers {
+		select {
+		case calls <- call:
+		default:
+		}
+	}
+}
+
+// writeEvents streams each newly recorded call as a server-sent event until the client goes away
+func writeEvents(resp http.ResponseWriter, req *http.Request) {
+	flusher, canFlush := resp.(http.Flusher)
+	if !canFlush {
+		resp.WriteHeader(500)
+		fmt.Fprintln(resp, "Streaming isn't supported on this connection")
+		return
+	}
+	calls := feed.subscribe()
+	defer feed.unsubscribe(calls)
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(200)
+	flusher.Flush()
+	// a comment now and then stops proxies from timing out a quiet stream
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case call := <-calls:
+			event, _ := json.Marshal(call)
+			fmt.Fprintf(resp, "id: %d\ndata: %s\n\n", call.Seq, event)
+		case <-keepAlive.C:
+			fmt.Fprint(resp, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		case <-shutdownChan:
+			// the stream would otherwise keep a graceful shutdown waiting forever
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// releaseWaiters wakes the waiters whose count has been reached, drops those that gave up, and
+// returns the ones still waiting
+func releaseWaiters(waiters []countWaiter, total int) []countWaiter {
+	waiting := waiters[:0]
+	for _, waiter := range waiters {
+		select {
+		case <-waiter.done:
+			continue
+		default:
+		}
+		if total >= waiter.count {
+			close(waiter.ready)
+		} else {
+			waiting = append(waiting, waiter)
+		}
+	}
+	clear(waiters[len(waiting):])
+	return waiting
+}
+
+// expireCalls drops the calls last seen before cutoff. Calls are newest first, so everything from
+// the first expired call on goes.
+func expireCalls(calls []requestRecord, cutoff time.Time) []requestRecord {
+	for i, call := range calls {
+		lastSeen := call.Timestamp
+		if call.LastSeen.After(lastSeen) {
+			lastSeen = call.LastSeen
+		}
+		if lastSeen.Before(cutoff) {
+			return calls[:i]
+		}
+	}
+	return calls
+}
+
+// sameCall reports whether two calls are repeats of each other for compaction
+func sameCall(a, b requestRecord) bool {
+	return a.Method == b.Method && a.Uri == b.Uri && a.PayloadHash == b.PayloadHash
+}
+
+// snapshotCalls returns a copy of the recorded calls, newest first, that is safe to read while calls keep arriving
+func snapshotCalls() []requestRecord {
+	copyTo := make(chan []requestRecord)
+	snapshotChan <- copyTo
+	return <-copyTo
+}
+
+func setFromQueryParam(param string, val *int) error {
+	if "" != param {
+		num, numErr := strconv.Atoi(param)
+		if nil != numErr {
+			return numErr
+		} else {
+			*val = num
+		}
+	}
+	return nil
+}
+
+// validStatus says whether status is a final status net/http will write. 1xx codes are left out
+// because net/http sends them as informational and follows with an implicit 200.
+func validStatus(status int) bool {
+	return status >= 200 && status <= 599
+}
+
+func setFloatFromQueryParam(param string, val *float64) error {
+	if "" != param {
+		num, numErr := strconv.ParseFloat(param, 64)
+		if nil != numErr {
+			return numErr
+		} else {
+			*val = num
+		}
+	}
+	return nil
+}
+
+// faultConfig is the fault injection configDelay sets, never changed once a handler can see it
+type faultConfig struct {
+	// in ms
+	delay, variance, burn, perKB, ramp, rampMax, preread int
+	// percentages
+	chance, truncate                     float64
+	everyN, everyNStatus, goroutineLimit int
+	// nil when there is no mix
+	statusMix *statusMix
+}
+
+// defaultFaults is the config putter starts with and reset-all goes back to
+func defaultFaults() faultConfig {
+	return faultConfig{everyNStatus: 503, goroutineLimit: goroutinelimit}
+}
+
+// statusMix answers with statuses at random in proportion to their weights, as set by
+// configDelay?statusMix=200:90,500:7,503:3
+type statusMix struct {
+	spec     string
+	statuses []int
+	// running totals of the weights, so a draw below cumulative[i] picks statuses[i]
+	cumulative []int
+}
+
+func parseStatusMix(spec string) (*statusMix, error) {
+	mix := &statusMix{spec: spec}
+	total := 0
+	for _, entry := range strings.Split(spec, ",") {
+		statusParam, weightParam, found := strings.Cut(entry, ":")
+		if !found {
+			return nil, errors.New("expected status:weight, got " + entry)
+		}
+		status, statusErr := strconv.Atoi(statusParam)
+		if nil != statusErr || !validStatus(status) {
+			return nil, errors.New("invalid status " + statusParam)
+		}
+		weight, weightErr := strconv.Atoi(weightParam)
+		if nil != weightErr || weight < 0 {
+			return nil, errors.New("invalid weight " + weightParam)
+		}
+		total += weight
+		mix.statuses = append(mix.statuses, status)
+		mix.cumulative = append(mix.cumulative, total)
+	}
+	if total == 0 {
+		return nil, errors.New("weights add up to nothing")
+	}
+	return mix, nil
+}
+
+func (m *statusMix) pick() int {
+	draw := random.Intn(m.cumulative[len(m.cumulative)-1])
+	for i, bound := range m.cumulative {
+		if draw < bound {
+			return m.statuses[i]
+		}
+	}
+	return m.statuses[len(m.statuses)-1]
+}
+
+// burnCPU keeps a core busy hashing for d, unlike a sleep, giving up early once done closes or
+// the server starts shutting down
+func burnCPU(d time.Duration, done <-chan struct{}) {
+	block := make([]byte, 1024)
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		select {
+		case <-done:
+			return
+		case <-shutdownChan:
+			return
+		default:
+		}
+		sum := sha256.Sum256(block)
+		copy(block, sum[:])
+	}
+}
+
+// reservoir keeps a uniform random sample of at most size of the durations added to it, so
+// percentiles stay cheap however long putter runs
+type reservoir struct {
+	lock    sync.Mutex
+	size    int
+	seen    int
+	samples []time.Duration
+}
+
+func (r *reservoir) add(d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.seen++
+	if len(r.samples) < r.size {
+		r.samples = append(r.samples, d)
+	} else if i := random.Intn(r.seen); i < r.size {
+		r.samples[i] = d
+	}
+}
+
+func (r *reservoir) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.seen = 0
+	r.samples = r.samples[:0]
+}
+
+// percentiles returns the sample at each of the given percentiles, nearest rank, and how many were seen
+func (r *reservoir) percentiles(ps ...float64) ([]time.Duration, int) {
+	r.lock.Lock()
+	sorted := slices.Clone(r.samples)
+	seen := r.seen
+	r.lock.Unlock()
+	slices.Sort(sorted)
+	values := make([]time.Duration, len(ps))
+	if len(sorted) == 0 {
+		return values, seen
+	}
+	for i, p := range ps {
+		rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		values[i] = sorted[min(max(rank, 0), len(sorted)-1)]
+	}
+	return values, seen
+}
+
+// rateLimiter lets through at most limit requests in each one second window, for -rps.
+// A limit of 0 lets everything through.
+type rateLimiter struct {
+	lock        sync.Mutex
+	windowStart time.Time
+	used        int
+}
+
+// take uses up one request from the current window if there is one left, saying how many remain
+// and how long until the window starts over
+func (l *rateLimiter) take() (bool, int, time.Duration) {
+	if rps <= 0 {
+		return true, 0, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Sub(l.windowStart) >= time.Second {
+		l.windowStart, l.used = now, 0
+	}
+	reset := l.windowStart.Add(time.Second).Sub(now)
+	if l.used >= rps {
+		return false, 0, reset
+	}
+	l.used++
+	return true, rps - l.used, reset
+}
+
+// holdBarrier keeps responses back until size of them are waiting, then lets them all go at
+// once, for configDelay?holdUntil=N. A size of 0 holds nothing.
+type holdBarrier struct {
+	lock    sync.Mutex
+	size    int
+	waiting int
+	release chan struct{}
+}
+
+// resize changes how many responses are held back, letting go of those already waiting if
+// that's now enough of them
+func (h *holdBarrier) resize(size int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.size = size
+	if h.waiting > 0 && h.waiting >= h.size {
+		h.open()
+	}
+}
+
+func (h *holdBarrier) limit() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.size
+}
+
+// open releases everyone waiting and starts a new batch, the lock must be held
+func (h *holdBarrier) open() {
+	if h.release != nil {
+		close(h.release)
+	}
+	h.release, h.waiting = make(chan struct{}), 0
+}
+
+// wait blocks until the batch this call joins is full, saying false when it gave up on it early
+// because of done, a shutdown or -hold-timeout
+func (h *holdBarrier) wait(done <-chan struct{}) bool {
+	h.lock.Lock()
+	if h.size <= 0 {
+		h.lock.Unlock()
+		return true
+	}
+	if h.release == nil {
+		h.release = make(chan struct{})
+	}
+	release := h.release
+	h.waiting++
+	if h.waiting >= h.size {
+		h.open()
+		h.lock.Unlock()
+		return true
+	}
+	h.lock.Unlock()
+	var timeout <-chan time.Time
+	if holdTimeout > 0 {
+		timer := time.NewTimer(holdTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-release:
+		return true
+	case <-done:
+	case <-shutdownChan:
+	case <-timeout:
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	select {
+	case <-release:
+		// the batch filled up just as this one gave up
+		return true
+	default:
+	}
+	h.waiting--
+	return false
+}
+
+// goroutineID parses the id of the calling goroutine out of the first line of its stack trace,
+// "goroutine 18 [running]:", with -debug-goid and 0 otherwise. It's slow and only for debugging,
+// nothing should depend on it.
+func goroutineID() int64 {
+	if !debugGoid {
+		return 0
+	}
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	field, _, _ := strings.Cut(strings.TrimPrefix(string(buf), "goroutine "), " ")
+	id, _ := strconv.ParseInt(field, 10, 64)
+	return id
+}
+
+// sampled decides at random whether a request served gets recorded, counting those that don't
+func sampled() bool {
+	if sampleRate >= 1 || random.Float64() < sampleRate {
+		return true
+	}
+	skippedCount.Add(1)
+	return false
+}
+
+// merkleChunk is how much of the payload each goroutine of merkleRoot hashes
+const merkleChunk = 1 << 20
+
+// merkleRoot hashes payload in merkleChunk pieces at once and returns the SHA-256 of their digests
+// in order. It is NOT the SHA-256 of the payload, nor any standard tree hash, so only compare it
+// with other roots from putter.
+func merkleRoot(payload []byte) []byte {
+	digests := make([]byte, (len(payload)+merkleChunk-1)/merkleChunk*sha256.Size)
+	var hashers sync.WaitGroup
+	for start := 0; start < len(payload); start += merkleChunk {
+		hashers.Add(1)
+		go func(start int) {
+			defer hashers.Done()
+			sum := sha256.Sum256(payload[start:min(start+merkleChunk, len(payload))])
+			copy(digests[start/merkleChunk*sha256.Size:], sum[:])
+		}(start)
+	}
+	hashers.Wait()
+	root := sha256.Sum256(digests)
+	return root[:]
+}
+
+// filler is the block padding is written from, so a huge size never needs a buffer of its own
+var filler = bytes.Repeat([]byte{'.'}, 32*1024)
+
+// writePadded writes msg and then filler bytes until at least size bytes have been written,
+// giving up at the first write that fails
+func writePadded(w io.Writer, msg string, size int) {
+	if _, writeErr := io.WriteString(w, msg); nil != writeErr {
+		return
+	}
+	for pad := size - len(msg); pad > 0; pad -= len(filler) {
+		if _, writeErr := w.Write(filler[:min(pad, len(filler))]); nil != writeErr {
+			return
+		}
+	}
+}
+
+// errCutOff is what cutOffWriter answers once its limit is reached
+var errCutOff = errors.New("cut off")
+
+// cutOffWriter passes on the first left bytes written to it and refuses the rest
+type cutOffWriter struct {
+	w    io.Writer
+	left int
+}
+
+func (c *cutOffWriter) Write(p []byte) (int, error) {
+	if c.left <= 0 {
+		return 0, errCutOff
+	}
+	n, writeErr := c.w.Write(p[:min(len(p), c.left)])
+	c.left -= n
+	if nil == writeErr && n < len(p) {
+		writeErr = errCutOff
+	}
+	return n, writeErr
+}
+
+// newRequestID makes a random (version 4) UUID for requests that did not bring their own X-Request-ID
+func newRequestID() string {
+	var id [16]byte
+	cryptorand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// missingHeader returns the first -require-header the request doesn't carry
+func missingHeader(req *http.Request) (string, bool) {
+	for _, name := range requiredHeaders {
+		if req.Header.Get(name) == "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// jwtClaims decodes the payload of a bearer JWT, skipping anything that isn't one.
+// The signature is never checked, this is for seeing what a client sent, not for trusting it.
+func jwtClaims(req *http.Request) map[string]any {
+	token, isBearer := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !isBearer {
+		return nil
+	}
+	segments := strings.Split(strings.TrimSpace(token), ".")
+	if len(segments) != 3 {
+		return nil
+	}
+	claimsJSON, decodeErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if nil != decodeErr {
+		return nil
+	}
+	var claims map[string]any
+	if nil != json.Unmarshal(claimsJSON, &claims) {
+		return nil
+	}
+	return claims
+}
+
+// pathParams matches path against a -path-pattern segment by segment, returning the {name} segments.
+// A last segment of {name...} takes the rest of the path.
+func pathParams(pattern, path string) (map[string]string, bool) {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	params := make(map[string]string)
+	for i, patternSegment := range patternSegments {
+		name, isParam := strings.CutPrefix(patternSegment, "{")
+		name, isParam = strings.CutSuffix(name, "}")
+		if rest, isRest := strings.CutSuffix(name, "..."); isParam && isRest && i == len(patternSegments)-1 {
+			if i >= len(pathSegments) {
+				return nil, false
+			}
+			params[rest] = strings.Join(pathSegments[i:], "/")
+			return params, true
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		if isParam {
+			params[name] = pathSegments[i]
+		} else if patternSegment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	if len(pathSegments) != len(patternSegments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// rejectedRecord describes a call that was turned away with status without reading its body
+func rejectedRecord(req *http.Request, status int, reason string) requestRecord {
+	return requestRecord{
+		Timestamp:        time.Now(),
+		Method:           req.Method,
+		Uri:              req.URL.RequestURI(),
+		Proto:            req.Proto,
+		Scheme:           requestScheme(req),
+		Status:           status,
+		Rejected:         reason,
+		UserAgent:        req.UserAgent(),
+		Headers:          recordHeaders(req),
+		HeaderHash:       headerHash(req),
+		HeaderCount:      headerCount(req),
+		DuplicateHeaders: duplicateHeaders(req),
+		HeaderBytes:      headerSize(req),
+	}
+}
+
+// requestScheme says whether req came in over TLS, or with -trust-xff whether it reached the proxy in front that way
+func requestScheme(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-Proto"); trustXFF && forwarded != "" {
+		return strings.ToLower(forwarded)
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// shellQuote wraps s in single quotes so a shell passes it through untouched
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// curlCommand renders a call as a curl invocation that replays it against host, with the scheme
+// and headers it came with
+func curlCommand(call requestRecord, host string) string {
+	scheme := call.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	cmd := "curl -X " + shellQuote(call.Method) + " " + shellQuote(scheme+"://"+host+call.Uri)
+	for _, name := range slices.Sorted(maps.Keys(call.Headers)) {
+		if name == "Content-Length" {
+			// curl works that out from the payload
+			continue
+		}
+		for _, value := range call.Headers[name] {
+			cmd += " -H " + shellQuote(name+": "+value)
+		}
+	}
+	if call.Payload != "" {
+		cmd += " --data-binary " + shellQuote(call.Payload)
+	}
+	return cmd
+}
+
+// writeRecordedRequests lists the recorded calls, newest first, optionally only those between since and until
+func writeRecordedRequests(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	var since, until time.Time
+	var timeErr error
+	if sinceParam := query.Get("since"); "" != sinceParam {
+		since, timeErr = time.Parse(time.RFC3339, sinceParam)
+	}
+	if untilParam := query.Get("until"); nil == timeErr && "" != untilParam {
+		until, timeErr = time.Parse(time.RFC3339, untilParam)
+	}
+	if nil != timeErr {
+		resp.WriteHeader(400)
+		fmt.Fprintln(resp, timeErr)
+		return
+	}
+	calls := snapshotCalls()
+	if !since.IsZero() || !until.IsZero() {
+		inRange := calls[:0]
+		for _, call := range calls {
+			if (since.IsZero() || !call.Timestamp.Before(since)) && (until.IsZero() || !call.Timestamp.After(until)) {
+				inRange = append(inRange, call)
+			}
+		}
+		calls = inRange
+	}
+	switch query.Get("format") {
+	case "json":
+		if fieldsParam := query.Get("fields"); fieldsParam != "" {
+			projected, projectErr := projectCalls(calls, strings.Split(fieldsParam, ","))
+			if nil != projectErr {
+				resp.WriteHeader(400)
+				fmt.Fprintln(resp, projectErr)
+				return
+			}
+			resp.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(resp).Encode(projected)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(calls)
+	case "har":
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(harFromCalls(calls, req.Host))
+	case "protobuf":
+		// length delimited RequestRecord messages, see record.proto
+		resp.Header().Set("Content-Type", "application/x-protobuf; delimited=true")
+		for _, call := range calls {
+			if writeErr := writeDelimitedRecord(resp, call); nil != writeErr {
+				fmt.Fprintln(os.Stderr, "protobuf records:", writeErr)
+				return
+			}
+		}
+	default:
+		for _, call := range calls {
+			fmt.Fprintln(resp, call)
+		}
+	}
+}
+
+// fieldAliases are the short names ?fields= takes besides the JSON keys of requestRecord
+var fieldAliases = map[string]string{
+	"hash": "payload_hash",
+	"size": "payload_size",
+}
+
+// projectCalls keeps only the named fields of each call, keyed by the names as given. Fields a call
+// leaves out of its JSON, like empty omitempty ones, are left out here too.
+func projectCalls(calls []requestRecord, fields []string) ([]map[string]json.RawMessage, error) {
+	known := make(map[string]bool)
+	recordType := reflect.TypeOf(requestRecord{})
+	for i := 0; i < recordType.NumField(); i++ {
+		name, _, _ := strings.Cut(recordType.Field(i).Tag.Get("json"), ",")
+		known[name] = true
+	}
+	keys := make([]string, len(fields))
+	for i, field := range fields {
+		keys[i] = field
+		if alias, isAlias := fieldAliases[field]; isAlias {
+			keys[i] = alias
+		}
+		if !known[keys[i]] {
+			return nil, errors.New("unknown field " + field)
+		}
+	}
+	projected := make([]map[string]json.RawMessage, 0, len(calls))
+	for _, call := range calls {
+		callJSON, marshalErr := json.Marshal(call)
+		if nil != marshalErr {
+			return nil, marshalErr
+		}
+		var all map[string]json.RawMessage
+		json.Unmarshal(callJSON, &all)
+		kept := make(map[string]json.RawMessage, len(fields))
+		for i, field := range fields {
+			if value, present := all[keys[i]]; present {
+				kept[field] = value
+			}
+		}
+		projected = append(projected, kept)
+	}
+	return projected, nil
+}
+
+// writeRecordedRequest looks up a single recorded call by its sequence number, or the newest one for "latest"
+func writeRecordedRequest(resp http.ResponseWriter, req *http.Request, seqParam string) {
+	seq, seqErr := strconv.Atoi(seqParam)
+	latest := seqParam == "latest"
+	if nil != seqErr && !latest {
+		resp.WriteHeader(400)
+		fmt.Fprintln(resp, seqErr)
+		return
+	}
+	decode := req.URL.Query().Get("decode")
+	if decode != "" && decode != "hexdump" {
+		resp.WriteHeader(400)
+		fmt.Fprintln(resp, "Unknown decode", decode)
+		return
+	}
+	if decode != "" && !storePayload {
+		resp.WriteHeader(404)
+		fmt.Fprintln(resp, "Payloads are only kept with -s")
+		return
+	}
+	for _, call := range snapshotCalls() {
+		// calls are newest first, so the first one is the latest
+		if call.Seq != seq && !latest {
+			continue
+		}
+		if decode == "hexdump" {
+			// the same offset, hex and ASCII columns as hexdump -C
+			io.WriteString(resp, hex.Dump([]byte(call.Payload)))
+			return
+		}
+		switch req.URL.Query().Get("format") {
+		case "json":
+			resp.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(resp).Encode(call)
+		case "curl":
+			fmt.Fprintln(resp, curlCommand(call, req.Host))
+		default:
+			fmt.Fprintln(resp, call)
+		}
+		return
+	}
+	resp.WriteHeader(404)
+	fmt.Fprintln(resp, "No recorded request", seqParam)
+}
+
+// findCall looks a call up by its sequence number, or failing that by the hash of its payload
+func findCall(calls []requestRecord, ref string) (requestRecord, bool) {
+	seq, seqErr := strconv.Atoi(ref)
+	for _, call := range calls {
+		if (nil == seqErr && call.Seq == seq) || (nil != seqErr && call.PayloadHash == ref && call.Rejected == "") {
+			return call, true
+		}
+	}
+	return requestRecord{}, false
+}
+
+// payloadDiff summarizes how two stored payloads differ byte for byte
+type payloadDiff struct {
+	// offset of the first byte that differs, -1 when the payloads are identical
+	FirstDifference int `json:"first_difference"`
+	// bytes that differ within the length both payloads share
+	DifferingBytes int `json:"differing_bytes"`
+	// how much longer b is than a
+	SizeDelta int `json:"size_delta"`
+}
+
+func diffPayloads(a, b string) payloadDiff {
+	diff := payloadDiff{FirstDifference: -1, SizeDelta: len(b) - len(a)}
+	shared := min(len(a), len(b))
+	for i := 0; i < shared; i++ {
+		if a[i] != b[i] {
+			if diff.FirstDifference < 0 {
+				diff.FirstDifference = i
+			}
+			diff.DifferingBytes++
+		}
+	}
+	if diff.FirstDifference < 0 && len(a) != len(b) {
+		diff.FirstDifference = shared
+	}
+	return diff
+}
+
+// writeBaselineDiff answers /diff with the recorded calls whose payload hash isn't in the -baseline
+// and the baseline hashes no recorded call had
+func writeBaselineDiff(resp http.ResponseWriter) {
+	type unexpectedCall struct {
+		Seq         int    `json:"seq"`
+		Method      string `json:"method"`
+		Uri         string `json:"uri"`
+		PayloadHash string `json:"payload_hash"`
+	}
+	diff := struct {
+		Unexpected []unexpectedCall `json:"unexpected"`
+		Unseen     []string         `json:"unseen"`
+	}{Unexpected: []unexpectedCall{}, Unseen: []string{}}
+	seen := make(map[string]bool)
+	for _, call := range snapshotCalls() {
+		if call.Rejected != "" {
+			continue
+		}
+		seen[call.PayloadHash] = true
+		if !slices.Contains(baseline, call.PayloadHash) {
+			diff.Unexpected = append(diff.Unexpected, unexpectedCall{call.Seq, call.Method, call.Uri, call.PayloadHash})
+		}
+	}
+	for _, hash := range baseline {
+		if !seen[hash] {
+			diff.Unseen = append(diff.Unseen, hash)
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(diff)
+}
+
+// writeComparison answers /compare, saying whether the calls a and b refer to carried the same payload
+func writeComparison(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	calls := snapshotCalls()
+	a, foundA := findCall(calls, query.Get("a"))
+	b, foundB := findCall(calls, query.Get("b"))
+	if !foundA || !foundB {
+		resp.WriteHeader(404)
+		fmt.Fprintln(resp, "Need two recorded requests to compare, got a:", query.Get("a"), "b:", query.Get("b"))
+		return
+	}
+	comparison := struct {
+		A        int          `json:"a"`
+		B        int          `json:"b"`
+		SameHash bool         `json:"same_hash"`
+		SameSize bool         `json:"same_size"`
+		Diff     *payloadDiff `json:"diff,omitempty"`
+	}{A: a.Seq, B: b.Seq, SameHash: a.PayloadHash == b.PayloadHash, SameSize: a.PayloadSize == b.PayloadSize}
+	if storePayload {
+		diff := diffPayloads(a.Payload, b.Payload)
+		comparison.Diff = &diff
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(comparison)
+}
+
+// mirrorCopy is what -mirror sends on of a recorded request, taken before its handler returns
+type mirrorCopy struct {
+	uri, method, contentType, requestID string
+	payload                             []byte
+}
+
+// mirrorQueue hands -mirror copies to a fixed number of senders, started on first use. When the
+// peer can't keep up and size copies are already waiting, more are dropped and logged rather than
+// piling up as goroutines that -g and /readyz would count.
+type mirrorQueue struct {
+	size, senders int
+	start         sync.Once
+	copies        chan mirrorCopy
+}
+
+func (q *mirrorQueue) send(copied mirrorCopy) {
+	q.start.Do(func() {
+		q.copies = make(chan mirrorCopy, q.size)
+		for range q.senders {
+			go func() {
+				for next := range q.copies {
+					mirror(next)
+				}
+			}()
+		}
+	})
+	select {
+	case q.copies <- copied:
+	default:
+		fmt.Fprintln(os.Stderr, "mirror: queue full, dropped", copied.method, copied.uri, copied.requestID)
+	}
+}
+
+// mirror POSTs a copy of a recorded request to the same URI under -mirror, passing the original
+// method and request ID along in headers so the peer's record can be matched up with this one
+func mirror(copied mirrorCopy) {
+	mirrorReq, reqErr := http.NewRequest(http.MethodPost, mirrorURL+copied.uri, bytes.NewReader(copied.payload))
+	if nil != reqErr {
+		fmt.Fprintln(os.Stderr, "mirror:", reqErr)
+		return
+	}
+	mirrorReq.Header.Set("X-Request-ID", copied.requestID)
+	mirrorReq.Header.Set("X-Putter-Mirror-Method", copied.method)
+	if copied.contentType != "" {
+		mirrorReq.Header.Set("Content-Type", copied.contentType)
+	}
+	mirrorResp, mirrorErr := mirrorClient.Do(mirrorReq)
+	if nil != mirrorErr {
+		fmt.Fprintln(os.Stderr, "mirror:", mirrorErr)
+		return
+	}
+	io.Copy(io.Discard, mirrorResp.Body)
+	mirrorResp.Body.Close()
+	if mirrorResp.StatusCode >= 400 {
+		fmt.Fprintln(os.Stderr, "mirror:", mirrorURL+copied.uri, "answered", mirrorResp.Status)
+	}
 }
 
-func (r requestRecord) String() string {
-	return r.Timestamp.Format(time.RFC3339) + " " + r.Method + " " + r.Uri + " " + strconv.Itoa(r.PayloadSize) + " " + r.PayloadHash + "\n\t" + r.Payload + "\n--\n"
+// recordHeaders copies the request headers for a record, hiding the values of -redact-headers
+func recordHeaders(req *http.Request) http.Header {
+	headers := req.Header.Clone()
+	for _, name := range redactedHeaders {
+		for i := range headers[name] {
+			headers[name][i] = "[REDACTED]"
+		}
+	}
+	return headers
 }
 
-var port, callCount, headerLimit, goroutinelimit int
-var bufferRequest, storePayload bool
-var recordedCalls []requestRecord
-var callChan chan requestRecord
-var delay, variance, chance int
-var random *rand.Rand
+func headerCount(req *http.Request) int {
+	count := 0
+	for _, values := range req.Header {
+		count += len(values)
+	}
+	return count
+}
 
-func init() {
-	flag.IntVar(&port, "p", 7758, "Listen Port")
-	flag.IntVar(&callCount, "c", 100, "Count of Calls to Record")
-	flag.IntVar(&headerLimit, "h", 1, "Header Size Limit in MB")
-	flag.BoolVar(&bufferRequest, "b", false, "Fully Buffer Input Before Hashing")
-	flag.IntVar(&goroutinelimit, "g", 0, "Go Routine Limit")
-	flag.BoolVar(&storePayload, "s", false, "Store Payload in addition to hashing it")
+// duplicateHeaders names the headers req has more than one line of, sorted
+func duplicateHeaders(req *http.Request) []string {
+	var duplicates []string
+	for name, values := range req.Header {
+		if len(values) > 1 {
+			duplicates = append(duplicates, name)
+		}
+	}
+	slices.Sort(duplicates)
+	return duplicates
 }
 
-func main() {
-	flag.Parse()
-	callChan = make(chan requestRecord, callCount)
-	recordedCalls = make([]requestRecord, 0, callCount)
-	go storeCalls(callChan)
-	// don't really care much about the seed, just avoiding using the default of 1
-	randSrc := rand.NewSource(time.Now().UnixNano())
-	random = rand.New(randSrc)
-	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: http.HandlerFunc(recordRequest)}
-	server.MaxHeaderBytes = http.DefaultMaxHeaderBytes * headerLimit
-	log.Println(server.ListenAndServe())
+// headerHash hashes the headers of req as recorded, so redacted values don't count, with -hash-headers
+func headerHash(req *http.Request) string {
+	if !hashHeaders {
+		return ""
+	}
+	headers := recordHeaders(req)
+	lines := []string{"Host:" + req.Host}
+	for name, values := range headers {
+		for _, value := range values {
+			lines = append(lines, name+":"+value)
+		}
+	}
+	slices.Sort(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(truncateDigest(sum[:]))
 }
 
-func storeCalls(c chan requestRecord) {
-	swapBuf := make([]requestRecord, 0, callCount)
-	for call := range c {
-		// clear this buffer for filling without reallocating and add the newest call
-		swapBuf = append(swapBuf, call)
-		// get existing calls
-		existingCalls := recordedCalls
-		if len(existingCalls) >= callCount {
-			// drop earliest call from list
-			recordedCalls = append(swapBuf, existingCalls[1:callCount]...)
+// headerSize approximates how many bytes the request line and headers took on the wire
+func headerSize(req *http.Request) int {
+	size := len(req.Method) + len(req.URL.RequestURI()) + len(req.Proto) + 4
+	// the server moves Host out of req.Header
+	if req.Host != "" {
+		size += len("Host") + len(req.Host) + 4
+	}
+	for key, values := range req.Header {
+		for _, value := range values {
+			size += len(key) + len(value) + 4
 		}
-		recordedCalls = append(swapBuf, existingCalls...)
-		// set swapBuf to the emptied existing buffer so it can start fresh next time without reallocating
-		swapBuf = existingCalls[:0]
 	}
+	return size
 }
 
-func setFromQueryParam(param string, val *int) error {
-	if "" != param {
-		num, numErr := strconv.Atoi(param)
-		if nil != numErr {
-			return numErr
+// limitHeaders records and answers 431 for requests whose headers are over the -h limit,
+// which the server would otherwise reject before any handler saw them
+func limitHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if headerSize(req) > http.DefaultMaxHeaderBytes*headerLimit {
+			call := rejectedRecord(req, 431, "header too large")
+			call.HeaderTooLarge = true
+			recordCall(req, call)
+			resp.WriteHeader(431)
+			fmt.Fprintln(resp, "Headers over the limit of", headerLimit, "MB")
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// recordedKey is where recoverPanic leaves the flag recordCall sets once a request is recorded
+type recordedKey struct{}
+
+// recordCall hands call over to storeCalls, noting on req that it has been recorded
+func recordCall(req *http.Request, call requestRecord) {
+	if recorded, tracked := req.Context().Value(recordedKey{}).(*atomic.Bool); tracked {
+		recorded.Store(true)
+	}
+	callChan <- call
+}
+
+// recoverPanic keeps a panicking handler from taking its connection down unrecorded, logging the
+// stack and, unless the handler had already recorded it, recording the call as a 500 instead
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		recorded := new(atomic.Bool)
+		req = req.WithContext(context.WithValue(req.Context(), recordedKey{}, recorded))
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// a deliberate abort, net/http already knows to drop the connection quietly
+				panic(recovered)
+			}
+			fmt.Fprintln(os.Stderr, "panic serving", req.Method, req.URL.RequestURI()+":", recovered)
+			os.Stderr.Write(debug.Stack())
+			if !recorded.Load() {
+				// the handler may have got as far as recording the call before panicking
+				call := rejectedRecord(req, 500, "handler panicked")
+				call.Panic = fmt.Sprint(recovered)
+				recordCall(req, call)
+			}
+			resp.WriteHeader(500)
+			fmt.Fprintln(resp, "internal error")
+		}()
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// limitHandshakes makes config queue TLS handshakes past limit. A slot is taken once the
+// ClientHello is in, ahead of the expensive key exchange, and freed when the handshake ends
+// either way, which is when crypto/tls cancels the hello's context.
+func limitHandshakes(config *tls.Config, limit int) {
+	slots := make(chan struct{}, limit)
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		select {
+		case slots <- struct{}{}:
+		case <-hello.Context().Done():
+			return nil, hello.Context().Err()
+		}
+		go func() {
+			<-hello.Context().Done()
+			<-slots
+		}()
+		// nil carries on with config as it is
+		return nil, nil
+	}
+}
+
+// limitListener stops accepting once limit connections are open, so further clients wait in the
+// listen backlog until one closes, the same as golang.org/x/net/netutil.LimitListener
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func newLimitListener(l net.Listener, limit int) net.Listener {
+	return limitListener{Listener: l, slots: make(chan struct{}, limit)}
+}
+
+func (l limitListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	conn, acceptErr := l.Listener.Accept()
+	if nil != acceptErr {
+		<-l.slots
+		return conn, acceptErr
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	closeErr := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return closeErr
+}
+
+// rawLineListener hands out connections that keep a copy of the first line the client sent.
+// Go's server parses the request line away before any handler runs, so this is the only way to see
+// it byte for byte. Later requests on a kept alive connection are interleaved with bodies in the
+// stream, so they fall back to the line reconstructed from the parsed request.
+type rawLineListener struct {
+	net.Listener
+}
+
+func (l rawLineListener) Accept() (net.Conn, error) {
+	conn, acceptErr := l.Listener.Accept()
+	if nil != acceptErr {
+		return conn, acceptErr
+	}
+	return &rawLineConn{Conn: conn}, nil
+}
+
+type rawLineConnKey struct{}
+
+type rawLineConn struct {
+	net.Conn
+	lock     sync.Mutex
+	line     []byte
+	complete bool
+	taken    bool
+}
+
+func (c *rawLineConn) Read(p []byte) (int, error) {
+	n, readErr := c.Conn.Read(p)
+	c.lock.Lock()
+	if !c.complete {
+		if end := bytes.IndexByte(p[:n], '\n'); end >= 0 {
+			c.line = append(c.line, p[:end+1]...)
+			c.complete = true
 		} else {
-			*val = num
+			c.line = append(c.line, p[:n]...)
 		}
 	}
-	return nil
+	c.lock.Unlock()
+	return n, readErr
+}
+
+// takeLine returns the raw first line of the connection, only to the first caller
+func (c *rawLineConn) takeLine() (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.complete || c.taken {
+		return "", false
+	}
+	c.taken = true
+	return strings.TrimRight(string(c.line), "\r\n"), true
+}
+
+// grpcWebFrames splits a gRPC-Web body into its frames, each a flags byte and a big endian length
+// followed by that many bytes. The high bit of the flags marks the trailer frame.
+func grpcWebFrames(body []byte) ([]grpcWebFrame, error) {
+	var frames []grpcWebFrame
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return frames, errors.New("incomplete frame header")
+		}
+		length := int(binary.BigEndian.Uint32(body[1:5]))
+		if len(body)-5 < length {
+			return frames, fmt.Errorf("frame of %d bytes with only %d left", length, len(body)-5)
+		}
+		frameHash := sha256.Sum256(body[5 : 5+length])
+		frames = append(frames, grpcWebFrame{
+			Trailer: body[0]&0x80 != 0,
+			Length:  length,
+			Hash:    hex.EncodeToString(frameHash[:]),
+		})
+		body = body[5+length:]
+	}
+	return frames, nil
+}
+
+// decompressors are the Content-Encodings -decompress can undo. Readers that are also Closers get
+// closed once the body has been read.
+var decompressors = map[string]func(compressed io.Reader) (io.Reader, error){
+	"gzip":   newGzipReader,
+	"x-gzip": newGzipReader,
+	// HTTP's deflate is zlib wrapped, not raw deflate
+	"deflate": func(compressed io.Reader) (io.Reader, error) { return zlib.NewReader(compressed) },
+	"br":      func(compressed io.Reader) (io.Reader, error) { return brotli.NewReader(compressed), nil },
+	"zstd":    newZstdReader,
+}
+
+func newGzipReader(compressed io.Reader) (io.Reader, error) {
+	return gzip.NewReader(compressed)
+}
+
+func newZstdReader(compressed io.Reader) (io.Reader, error) {
+	// one goroutine decodes in step with the reads, and closing the reader releases the decoder
+	decoder, decoderErr := zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1))
+	if nil != decoderErr {
+		return nil, decoderErr
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// decompressor undoes a Content-Encoding, or returns nil for encodings it doesn't know
+func decompressor(encoding string, compressed io.Reader) (io.Reader, error) {
+	if newReader, known := decompressors[encoding]; known {
+		return newReader(compressed)
+	}
+	return nil, nil
+}
+
+// canonicalize re-encodes a JSON document with sorted object keys and no insignificant whitespace.
+// Numbers are kept exactly as written.
+func canonicalize(document []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value any
+	if decodeErr := decoder.Decode(&value); nil != decodeErr {
+		return nil, decodeErr
+	}
+	if decoder.More() {
+		return nil, errors.New("more than one JSON value")
+	}
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	// maps are always encoded with their keys sorted
+	if encodeErr := encoder.Encode(value); nil != encodeErr {
+		return nil, encodeErr
+	}
+	return bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), nil
+}
+
+// truncateDigest shortens a digest to -hash-len bytes
+func truncateDigest(digest []byte) []byte {
+	if hashLen > 0 && hashLen < len(digest) {
+		return digest[:hashLen]
+	}
+	return digest
+}
+
+// errReader fails every read with err
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// prefixWriter passes on only the first remaining bytes written to it and quietly drops the rest
+type prefixWriter struct {
+	w         io.Writer
+	remaining int
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if p.remaining > 0 {
+		kept := b[:min(len(b), p.remaining)]
+		p.remaining -= len(kept)
+		if _, writeErr := p.w.Write(kept); nil != writeErr {
+			return 0, writeErr
+		}
+	}
+	return len(b), nil
+}
+
+// bodyProfile watches a body go by to guess whether it is text, count its lines and measure its entropy
+type bodyProfile struct {
+	size     int
+	binary   bool
+	newlines int
+	last     byte
+	counts   [256]int
+}
+
+func (t *bodyProfile) Write(b []byte) (int, error) {
+	for _, c := range b {
+		t.counts[c]++
+		if c == '\n' {
+			t.newlines++
+		} else if (c < 0x20 && c != '\t' && c != '\r' && c != '\f') || c == 0x7f {
+			t.binary = true
+		}
+	}
+	if len(b) > 0 {
+		t.size += len(b)
+		t.last = b[len(b)-1]
+	}
+	return len(b), nil
+}
+
+// entropy is the Shannon entropy of the byte frequencies in bits per byte, near 0 for a body of one
+// repeated byte and near 8 for compressed, encrypted or random ones
+func (t *bodyProfile) entropy() float64 {
+	bits := 0.0
+	for _, count := range t.counts {
+		if count > 0 {
+			p := float64(count) / float64(t.size)
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
+
+func (t *bodyProfile) isText() bool {
+	return t.size > 0 && !t.binary
+}
+
+// lines counts a final line without a trailing newline too. Binary bodies have no lines to speak of.
+func (t *bodyProfile) lines() int {
+	if !t.isText() {
+		return 0
+	}
+	if t.last != '\n' {
+		return t.newlines + 1
+	}
+	return t.newlines
+}
+
+// trickleWriter passes writes on in small flushed chunks with a pause after each, giving up once
+// the request is done or the server is shutting down so a trickle can't outlive its client or
+// hold up a graceful shutdown
+type trickleWriter struct {
+	resp  http.ResponseWriter
+	done  <-chan struct{}
+	chunk int
+	pause time.Duration
+}
+
+func (t trickleWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, writeErr := t.resp.Write(p[written:min(written+t.chunk, len(p))])
+		written += n
+		if nil != writeErr {
+			return written, writeErr
+		}
+		if flusher, canFlush := t.resp.(http.Flusher); canFlush {
+			flusher.Flush()
+		}
+		select {
+		case <-t.done:
+			return written, errors.New("request finished mid trickle")
+		case <-shutdownChan:
+			return written, errors.New("shutting down mid trickle")
+		case <-time.After(t.pause):
+		}
+	}
+	return written, nil
+}
+
+// closeConnection takes the connection away from the server and closes it, leaving whatever
+// was written so far as all the client gets. With reset it is dropped as abruptly as the platform allows.
+func closeConnection(resp http.ResponseWriter, reset bool) {
+	hijacker, canHijack := resp.(http.Hijacker)
+	if !canHijack {
+		return
+	}
+	conn, _, hijackErr := hijacker.Hijack()
+	if nil != hijackErr {
+		fmt.Fprintln(os.Stderr, hijackErr)
+		return
+	}
+	if tcpConn, isTCP := conn.(*net.TCPConn); isTCP && reset {
+		// discard unsent data so the client sees a RST instead of a clean FIN
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
 }
 
 func recordRequest(resp http.ResponseWriter, req *http.Request) {
+	faults := currentFaults.Load()
 
-	if goroutinelimit > 0 && runtime.NumGoroutine() > goroutinelimit {
+	// putter's own endpoints live under adminPrefix so they can't swallow the traffic under test,
+	// and also keep answering at the exact root paths they were first served from
+	adminPath, isAdmin := strings.CutPrefix(req.URL.Path, adminPrefix+"/")
+	if isAdmin {
+		adminPath = "/" + adminPath
+	} else if isRootAdminPath(req.URL.Path) {
+		adminPath, isAdmin = req.URL.Path, true
+	}
+
+	if faults.goroutineLimit > 0 && runtime.NumGoroutine() > faults.goroutineLimit {
+		// recorded without reading the body, so shedding load stays cheap
+		recordCall(req, rejectedRecord(req, 503, "goroutine limit"))
 		resp.WriteHeader(503)
-		fmt.Fprintln(resp, "Hit the Go Routine limit of:", goroutinelimit)
+		fmt.Fprintln(resp, "Hit the Go Routine limit of:", faults.goroutineLimit)
 	} else if req.URL.Path == "/favicon.ico" {
 		resp.WriteHeader(404)
 		fmt.Fprintln(resp, "No icon for you!")
-	} else if strings.Contains(req.URL.Path, "recordedRequests") {
-		for _, call := range recordedCalls {
-			fmt.Fprintln(resp, call)
+	} else if isAdmin && adminPath == "/readyz" {
+		// goes unready before -g starts turning requests away, so orchestrators can steer traffic elsewhere first
+		if goroutines := runtime.NumGoroutine(); readyGoroutineThreshold > 0 && goroutines > readyGoroutineThreshold {
+			resp.WriteHeader(503)
+			fmt.Fprintln(resp, "not ready,", goroutines, "goroutines is over", readyGoroutineThreshold)
+			return
+		}
+		fmt.Fprintln(resp, "ready")
+	} else if isAdmin && adminPath == "/stats/paths" {
+		withQuery := req.URL.Query().Get("withQuery") == "true"
+		counts := make(map[string]int)
+		for _, call := range snapshotCalls() {
+			key := call.Uri
+			if !withQuery {
+				key, _, _ = strings.Cut(key, "?")
+			}
+			counts[key]++
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(counts)
+	} else if serveEvents && isAdmin && adminPath == "/events" {
+		writeEvents(resp, req)
+	} else if isAdmin && adminPath == "/stats" {
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(map[string]any{
+			"served":      servedCount.Load(),
+			"sample_rate": sampleRate,
+			"skipped":     skippedCount.Load(),
+		})
+	} else if isAdmin && adminPath == "/stats/latency" {
+		values, seen := delaySamples.percentiles(50, 90, 99)
+		millis := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(map[string]any{
+			"requests": seen,
+			"p50_ms":   millis(values[0]),
+			"p90_ms":   millis(values[1]),
+			"p99_ms":   millis(values[2]),
+		})
+	} else if baselineFile != "" && isAdmin && adminPath == "/diff" {
+		writeBaselineDiff(resp)
+	} else if isAdmin && adminPath == "/compare" {
+		writeComparison(resp, req)
+	} else if isAdmin && adminPath == "/waitFor" {
+		query := req.URL.Query()
+		count, timeout := 1, 10*time.Second
+		countErr := setFromQueryParam(query.Get("count"), &count)
+		if timeoutParam := query.Get("timeout"); nil == countErr && "" != timeoutParam {
+			timeout, countErr = time.ParseDuration(timeoutParam)
+		}
+		if nil != countErr {
+			resp.WriteHeader(400)
+			fmt.Fprintln(resp, countErr)
+			return
 		}
-	} else if strings.Contains(req.URL.Path, "configDelay") {
+		waitCtx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		waiter := countWaiter{count: count, ready: make(chan struct{}), done: waitCtx.Done()}
+		waitChan <- waiter
+		select {
+		case <-waiter.ready:
+			fmt.Fprintln(resp, "recorded at least", count, "requests")
+		case <-waitCtx.Done():
+			if errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+				resp.WriteHeader(408)
+				fmt.Fprintln(resp, "timed out after", timeout, "waiting for", count, "requests")
+			}
+		}
+	} else if hash, isReplay := strings.CutPrefix(adminPath, "/replay/"); isAdmin && isReplay {
+		if !storePayload {
+			resp.WriteHeader(404)
+			fmt.Fprintln(resp, "Payloads are only kept with -s")
+			return
+		}
+		for _, call := range snapshotCalls() {
+			if call.PayloadHash == hash && call.Rejected == "" {
+				io.WriteString(resp, call.Payload)
+				return
+			}
+		}
+		resp.WriteHeader(404)
+		fmt.Fprintln(resp, "No recorded payload with hash", hash)
+	} else if seqParam, isLookup := strings.CutPrefix(adminPath, "/recordedRequests/"); isAdmin && isLookup {
+		writeRecordedRequest(resp, req, seqParam)
+	} else if isAdmin && adminPath == "/recordedRequests" {
+		writeRecordedRequests(resp, req)
+	} else if isAdmin && adminPath == "/reset-all" {
+		if req.Method != http.MethodPost {
+			resp.Header().Set("Allow", http.MethodPost)
+			resp.WriteHeader(405)
+			fmt.Fprintln(resp, "reset-all requires POST")
+			return
+		}
+		cleared := make(chan int)
+		clearChan <- cleared
+		clearedCount := <-cleared
+		config := defaultFaults()
+		configLock.Lock()
+		currentFaults.Store(&config)
+		configLock.Unlock()
+		servedCount.Store(0)
+		skippedCount.Store(0)
+		scriptCount.Store(0)
+		delaySamples.reset()
+		holds.resize(0)
+		fmt.Fprintf(resp, "recorded requests cleared: %d\ndelay: %dms\nvariance: %dms\nchance: %g%%\nevery N: %d\ntruncate: %g%%\nserved count: %d\n", clearedCount, config.delay, config.variance, config.chance, config.everyN, config.truncate, servedCount.Load())
+	} else if isAdmin && adminPath == "/configDelay" {
 		query := req.URL.Query()
-		setFromQueryParam(query.Get("delay"), &delay)
-		setFromQueryParam(query.Get("variance"), &variance)
-		setFromQueryParam(query.Get("chance"), &chance)
-		setFromQueryParam(query.Get("limit"), &goroutinelimit)
-		fmt.Fprintf(resp, "delay: %dms\nvariance: %dms\nchance: %d%%\nGo routine 'limit': %d\n", delay, variance, chance, goroutinelimit)
+		configLock.Lock()
+		defer configLock.Unlock()
+		config := *currentFaults.Load()
+		if query.Has("statusMix") {
+			if mixParam := query.Get("statusMix"); mixParam == "" {
+				config.statusMix = nil
+			} else if mix, mixErr := parseStatusMix(mixParam); nil != mixErr {
+				resp.WriteHeader(400)
+				fmt.Fprintln(resp, "Invalid statusMix", mixParam, mixErr)
+				return
+			} else {
+				config.statusMix = mix
+			}
+		}
+		setFromQueryParam(query.Get("delay"), &config.delay)
+		setFromQueryParam(query.Get("burn"), &config.burn)
+		setFromQueryParam(query.Get("perKB"), &config.perKB)
+		setFromQueryParam(query.Get("ramp"), &config.ramp)
+		setFromQueryParam(query.Get("preread"), &config.preread)
+		setFromQueryParam(query.Get("rampMax"), &config.rampMax)
+		setFromQueryParam(query.Get("variance"), &config.variance)
+		setFloatFromQueryParam(query.Get("chance"), &config.chance)
+		setFromQueryParam(query.Get("limit"), &config.goroutineLimit)
+		setFromQueryParam(query.Get("everyN"), &config.everyN)
+		if statusErr := setFromQueryParam(query.Get("everyNStatus"), &config.everyNStatus); nil != statusErr || !validStatus(config.everyNStatus) {
+			resp.WriteHeader(400)
+			fmt.Fprintln(resp, "Invalid everyNStatus", query.Get("everyNStatus"))
+			return
+		}
+		setFloatFromQueryParam(query.Get("truncate"), &config.truncate)
+		holdUntil := holds.limit()
+		if holdErr := setFromQueryParam(query.Get("holdUntil"), &holdUntil); nil != holdErr || holdUntil < 0 {
+			resp.WriteHeader(400)
+			fmt.Fprintln(resp, "Invalid holdUntil", query.Get("holdUntil"))
+			return
+		}
+		currentFaults.Store(&config)
+		holds.resize(holdUntil)
+		mixSpec := "none"
+		if config.statusMix != nil {
+			mixSpec = config.statusMix.spec
+		}
+		fmt.Fprintf(resp, "delay: %dms\nvariance: %dms\nchance: %g%%\nGo routine 'limit': %d\nevery N: %d (status %d)\ntruncate: %g%%\nstatus mix: %s\nburn: %dms\nper KB: %dms\nramp: %dms per 100 requests, up to %dms\npreread: %dms\nhold until: %d\n", config.delay, config.variance, config.chance, config.goroutineLimit, config.everyN, config.everyNStatus, config.truncate, mixSpec, config.burn, config.perKB, config.ramp, config.rampMax, config.preread, holdUntil)
+	} else if isAdmin {
+		resp.WriteHeader(404)
+		fmt.Fprintln(resp, "No putter endpoint at", req.URL.Path)
+	} else if req.Method == "PRI" && req.RequestURI == "*" {
+		// an HTTP/2 prior knowledge preface, which net/http passes through when -h2c isn't taking it
+		recordCall(req, rejectedRecord(req, 505, "http/2 preface"))
+		resp.WriteHeader(505)
+		fmt.Fprintln(resp, "Got an HTTP/2 connection preface but only HTTP/1.x is served here, start putter with -h2c for cleartext HTTP/2")
+	} else if maxURI > 0 && len(req.URL.RequestURI()) > maxURI {
+		call := rejectedRecord(req, 414, "uri too long")
+		// keep only as much of the URI as would have been allowed
+		call.Uri = call.Uri[:maxURI]
+		call.URITooLong = true
+		recordCall(req, call)
+		resp.WriteHeader(414)
+		fmt.Fprintln(resp, "URI over the limit of", maxURI, "bytes")
+	} else if len(allowedMethods) > 0 && !slices.Contains(allowedMethods, req.Method) {
+		recordCall(req, rejectedRecord(req, 405, "method not allowed"))
+		resp.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		resp.WriteHeader(405)
+		fmt.Fprintln(resp, req.Method, "not allowed")
+	} else if name, missing := missingHeader(req); missing {
+		recordCall(req, rejectedRecord(req, requiredHeaderStatus, "missing header "+name))
+		resp.WriteHeader(requiredHeaderStatus)
+		fmt.Fprintln(resp, "Missing required header", name)
+	} else if rejectExpect && strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		// not touching the body means the server never sends the 100 Continue
+		recordCall(req, rejectedRecord(req, 417, "expectation failed"))
+		resp.WriteHeader(417)
+		fmt.Fprintln(resp, "Not continuing, expectation failed")
+	} else if allowed, remaining, reset := requestLimiter.take(); !allowed {
+		recordCall(req, rejectedRecord(req, 429, "rate limited"))
+		// seconds until the window resets, rounded up, as in the IETF RateLimit header draft
+		resetSeconds := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+		resp.Header().Set("X-RateLimit-Limit", strconv.Itoa(rps))
+		resp.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		resp.Header().Set("X-RateLimit-Reset", resetSeconds)
+		resp.Header().Set("Retry-After", resetSeconds)
+		resp.WriteHeader(429)
+		fmt.Fprintln(resp, "Over the limit of", rps, "requests per second")
 	} else {
+		// HTTP/1.0 clients only keep the connection open when the response says so. net/http says so
+		// itself when it knows the body's length, -echo-connection also covers the bodies it doesn't.
+		isKeepAlive10 := req.ProtoMajor == 1 && req.ProtoMinor == 0 && strings.EqualFold(req.Header.Get("Connection"), "keep-alive")
+		if noKeepAlive {
+			resp.Header().Set("Connection", "close")
+		} else if isKeepAlive10 && echoConnection {
+			resp.Header().Set("Connection", "keep-alive")
+		}
+		served := servedCount.Add(1)
+		if maxRequests > 0 && served >= maxRequests {
+			defer shutdownOnce.Do(func() { close(shutdownChan) })
+		}
+		requestID := req.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		resp.Header().Set("X-Request-ID", requestID)
+		// RequestURI is the target exactly as sent, unlike the re-encoded req.URL.RequestURI()
+		requestLine := req.Method + " " + req.RequestURI + " " + req.Proto
+		if rawConn, isRaw := req.Context().Value(rawLineConnKey{}).(*rawLineConn); isRaw {
+			if line, taken := rawConn.takeLine(); taken {
+				requestLine = line
+			}
+		}
+		if faults.preread > 0 && time.Since(startTime) >= warmup {
+			// leaves the body sitting unread, so the client sees its upload stall rather than the response
+			select {
+			case <-time.After(time.Duration(faults.preread) * time.Millisecond):
+			case <-req.Context().Done():
+			}
+		}
+		if rawChunks && slices.Contains(req.TransferEncoding, "chunked") {
+			recordRawChunks(resp, req, requestID, requestLine)
+			return
+		}
+		sinkWriter := payloadSink.NewWriter(requestRecord{
+			Timestamp:   time.Now(),
+			Method:      req.Method,
+			Uri:         req.URL.RequestURI(),
+			Proto:       req.Proto,
+			RequestID:   requestID,
+			RequestLine: requestLine,
+		})
+		// the body goes through the hasher on its way in and the rest of the handler sees the decompressed payload
+		var source io.Reader = req.Body
+		var wire io.Reader
+		wireHasher := sha256.New()
+		contentEncoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		if decompress {
+			wire = io.TeeReader(req.Body, wireHasher)
+			decompressed, decompressErr := decompressor(contentEncoding, wire)
+			if nil != decompressErr {
+				source = errReader{decompressErr}
+			} else if decompressed != nil {
+				source = decompressed
+				if closer, canClose := decompressed.(io.Closer); canClose {
+					defer closer.Close()
+				}
+			} else {
+				wire = nil
+			}
+		}
+		status := 200
 		var bytesRead int64
 		var rawHash, payload []byte
 		var readErr error
-		if bufferRequest || storePayload {
-			var buf bytes.Buffer
-			bytesRead, readErr = buf.ReadFrom(req.Body)
+		var readMode string
+		var canonicalized, parallelHashed bool
+		var readDuration, hashDuration time.Duration
+		var profile bodyProfile
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		isForm := recordForm && mediaType == "application/x-www-form-urlencoded"
+		isGrpcWeb := grpcWeb && (mediaType == "application/grpc-web+proto" || mediaType == "application/grpc-web")
+		isJSON := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+		isValidated := requestSchema != nil && isJSON
+		isCanonical := canonicalJSON && isJSON
+		buffered := bufferRequest || storePayload
+		if bufferUnder > 0 {
+			// a body of unknown length could be any size, so it streams
+			buffered = req.ContentLength >= 0 && req.ContentLength < bufferUnder
+		}
+		if buffered || echoBody || isForm || isGrpcWeb || isValidated || isCanonical || mirrorURL != "" {
+			readMode = "buffered"
+			buf := payloadBufPool.Get().(*bytes.Buffer)
+			buf.Reset()
+			defer func() {
+				if buf.Cap() <= maxPooledBuffer {
+					payloadBufPool.Put(buf)
+				}
+			}()
+			readStart := time.Now()
+			bytesRead, readErr = buf.ReadFrom(source)
+			readDuration = time.Since(readStart)
 			if nil != readErr {
-				resp.WriteHeader(500)
-				fmt.Fprintln(resp, readErr)
+				status = 500
 				fmt.Fprintln(os.Stderr, readErr)
 			}
+			// still backed by the pooled buffer, the record gets its own copy via string(payload)
 			payload = buf.Bytes()
-			rawHashArray := sha256.Sum256(payload)
-			rawHash = rawHashArray[:]
+			sinkWriter.Write(payload)
+			profile.Write(payload)
+			hashed := payload
+			if isCanonical {
+				if canonical, canonicalErr := canonicalize(payload); nil != canonicalErr {
+					// not really JSON, so the bytes as sent are all there is to hash
+					fmt.Fprintln(os.Stderr, "canonical json:", canonicalErr)
+				} else {
+					hashed = canonical
+					canonicalized = true
+				}
+			}
+			if hashPrefix > 0 {
+				hashed = hashed[:min(len(hashed), hashPrefix)]
+			}
+			hashStart := time.Now()
+			if parallelHash > 0 && len(hashed) > parallelHash {
+				rawHash = merkleRoot(hashed)
+				parallelHashed = true
+			} else {
+				rawHashArray := sha256.Sum256(hashed)
+				rawHash = rawHashArray[:]
+			}
+			hashDuration = time.Since(hashStart)
 		} else {
-			buf := make([]byte, 0x8000)
+			readMode = "streaming"
+			readBuf := readBufPool.Get().(*[]byte)
+			defer readBufPool.Put(readBuf)
+			buf := *readBuf
+			readStart := time.Now()
 			var justRead int
-			justRead, readErr = req.Body.Read(buf)
+			justRead, readErr = source.Read(buf)
 			bytesRead += int64(justRead)
 			hasher := sha256.New()
-			hasher.Write(buf[:justRead])
+			var hashTo io.Writer = hasher
+			if hashPrefix > 0 {
+				hashTo = &prefixWriter{w: hasher, remaining: hashPrefix}
+			}
+			hashTo = io.MultiWriter(hashTo, sinkWriter, &profile)
+			hashStart := time.Now()
+			hashTo.Write(buf[:justRead])
+			hashDuration += time.Since(hashStart)
 			for justRead > 0 && readErr == nil {
-				justRead, readErr = req.Body.Read(buf)
+				justRead, readErr = source.Read(buf)
 				bytesRead += int64(justRead)
-				hasher.Write(buf[:justRead])
+				hashStart = time.Now()
+				hashTo.Write(buf[:justRead])
+				hashDuration += time.Since(hashStart)
 			}
+			readDuration = time.Since(readStart)
 			if nil != readErr && !errors.Is(readErr, io.EOF) {
-				resp.WriteHeader(500)
-				fmt.Fprintln(resp, readErr)
+				status = 500
 				fmt.Fprintln(os.Stderr, readErr)
 			} else {
 				rawHash = hasher.Sum(nil)
 			}
 		}
 
-		hexHash := hex.EncodeToString(rawHash)
-		callChan <- requestRecord{
-			Timestamp:   time.Now(),
-			Method:      req.Method,
-			Uri:         req.URL.RequestURI(),
-			PayloadSize: int(bytesRead),
-			PayloadHash: hexHash,
-			Payload:     string(payload),
+		if closeErr := sinkWriter.Close(); nil != closeErr {
+			fmt.Fprintln(os.Stderr, "sink:", closeErr)
 		}
-		fmt.Fprintln(resp, req.URL.Path, "received")
 
-		// stall response close after writing response
-		if chance > 0 {
-			if chance >= random.Intn(100) {
+		var form url.Values
+		if isForm {
+			// parsed from the buffered copy rather than req.ParseForm so the raw body is still there to hash
+			var formErr error
+			form, formErr = url.ParseQuery(string(payload))
+			if nil != formErr {
+				fmt.Fprintln(os.Stderr, "form:", formErr)
+			}
+		}
+
+		var frames []grpcWebFrame
+		if isGrpcWeb {
+			var framesErr error
+			frames, framesErr = grpcWebFrames(payload)
+			if nil != framesErr {
+				fmt.Fprintln(os.Stderr, "grpc-web:", framesErr)
+			}
+		}
+
+		var schemaErrors []string
+		if isValidated && status == 200 {
+			if schemaErrors = requestSchema.validate(payload); len(schemaErrors) > 0 {
+				status = 422
+			}
+		}
+
+		hexHash := hex.EncodeToString(truncateDigest(rawHash))
+
+		// per request faults, none of which mask a real read failure
+		forcedDelay, reset, truncated := -1, false, false
+		var matchedRule string
+		message := req.URL.Path + " received\n"
+		if len(schemaErrors) > 0 {
+			message = "schema validation failed:\n" + strings.Join(schemaErrors, "\n") + "\n"
+		} else if echoBody {
+			message = string(payload)
+			if contentType := req.Header.Get("Content-Type"); contentType != "" {
+				resp.Header().Set("Content-Type", contentType)
+			}
+		}
+		// anything but 200 by now means the request itself was bad or couldn't be read
+		accepted := status == 200
+		if accepted {
+			if matched, found := matchRule(req, hexHash); found {
+				status, message, matchedRule = matched.Status, matched.Body, matched.Name
+				if matched.Name != "" {
+					resp.Header().Set("X-Matched-Rule", matched.Name)
+				}
+				if matched.Location != "" {
+					resp.Header().Set("Location", matched.Location)
+				}
+			} else if script := *responseScript.Load(); len(script) > 0 {
+				step := script[(scriptCount.Add(1)-1)%int64(len(script))]
+				status, message = step.Status, step.Body
+			} else if body, contentType, found, fileErr := responseFile(req, requestID, hexHash); found {
+				message = body
+				if nil != fileErr {
+					status = 500
+					fmt.Fprintln(os.Stderr, "response file:", fileErr)
+				} else if contentType != "" {
+					resp.Header().Set("Content-Type", contentType)
+				}
+			} else if len(representations) > 0 {
+				resp.Header().Set("Vary", "Accept")
+				if chosen, found := negotiate(req.Header.Get("Accept")); found {
+					message = chosen.body
+					resp.Header().Set("Content-Type", chosen.mediaType)
+				} else {
+					status = 406
+					message = "None of " + strings.Join(representationTypes(), ", ") + " is acceptable\n"
+				}
+			}
+		}
+		if mirrorHeader != "" {
+			// shows whether a header made it through whatever sits between the client and putter
+			message += mirrorHeader + ": " + req.Header.Get(mirrorHeader) + "\n"
+		}
+		warmingUp := time.Since(startTime) < warmup
+		if accepted && !warmingUp {
+			if faults.statusMix != nil {
+				status = faults.statusMix.pick()
+			}
+			if faults.everyN > 0 && served%int64(faults.everyN) == 0 {
+				status = faults.everyNStatus
+			}
+			truncated = faults.truncate > 0 && random.Float64()*100 < faults.truncate
+			// overrides so tests can ask for exactly one behavior
+			if allowHeaderFaults {
+				reset = req.Header.Get("X-Putter-Reset") == "1"
+				if req.Header.Get("X-Putter-Panic") == "1" {
+					// for testing -recover, before anything is recorded so the panic's record is the only one
+					panic("X-Putter-Panic")
+				}
+				// anything but a three digit status would make WriteHeader panic, so it is ignored
+				if override, overrideErr := strconv.Atoi(req.Header.Get("X-Putter-Status")); nil == overrideErr && validStatus(override) {
+					status = override
+				}
+				setFromQueryParam(req.Header.Get("X-Putter-Delay"), &forcedDelay)
+			}
+		}
+
+		// the stall comes after the body, but is settled now so Server-Timing can own up to it
+		var stall time.Duration
+		if forcedDelay >= 0 {
+			stall = time.Millisecond * time.Duration(forcedDelay)
+		} else if faults.chance > 0 && !warmingUp {
+			if random.Float64()*100 < faults.chance {
 				var shift int
-				if variance > 0 {
-					shift = random.Intn(variance) - variance/2
+				if faults.variance > 0 {
+					shift = random.Intn(faults.variance) - faults.variance/2
 				}
-				time.Sleep(time.Millisecond * time.Duration(delay+shift))
+				stall = time.Millisecond * time.Duration(max(faults.delay+shift, 0))
+			}
+		}
+		if jitter > 0 && !warmingUp {
+			stall += time.Millisecond * time.Duration(random.Intn(jitter+1))
+		}
+		if faults.perKB > 0 && !warmingUp {
+			// scales with the body as read, pro rata for partial KBs
+			stall += time.Duration(faults.perKB) * time.Millisecond * time.Duration(bytesRead) / 1024
+		}
+		if faults.ramp > 0 && !warmingUp {
+			// grows with requests served so far, like a backend wearing down, up to rampMax if set
+			rampDelay := time.Duration(faults.ramp) * time.Millisecond * time.Duration(served) / 100
+			if faults.rampMax > 0 {
+				rampDelay = min(rampDelay, time.Duration(faults.rampMax)*time.Millisecond)
+			}
+			stall += rampDelay
+		}
+		if truncated {
+			// the connection gets dropped before the stall would come round
+			stall = 0
+		}
+		var burnFor time.Duration
+		if !warmingUp {
+			burnFor = time.Duration(faults.burn) * time.Millisecond
+		}
+
+		latency := minLatency
+		if maxDelay > 0 {
+			// -min-latency, then burn, then the stall get whatever is left under the cap
+			latency = min(latency, maxDelay)
+			burnFor = min(burnFor, maxDelay-latency)
+			stall = min(stall, maxDelay-latency-burnFor)
+		}
+		applied := latency + burnFor + stall
+		delaySamples.add(applied)
+
+		var claims map[string]any
+		if decodeJWT {
+			claims = jwtClaims(req)
+		}
+		var params map[string]string
+		if pathPattern != "" {
+			params, _ = pathParams(pathPattern, req.URL.Path)
+		}
+
+		rawHexHash := hexHash
+		if canonicalized {
+			wireHash := sha256.Sum256(payload)
+			rawHexHash = hex.EncodeToString(truncateDigest(wireHash[:]))
+		}
+		if wire != nil {
+			// anything after the end of the compressed stream still counts as part of what was sent
+			io.Copy(io.Discard, wire)
+			rawHexHash = hex.EncodeToString(truncateDigest(wireHasher.Sum(nil)))
+		}
+		call := requestRecord{
+			Timestamp:        time.Now(),
+			Method:           req.Method,
+			Uri:              req.URL.RequestURI(),
+			Proto:            req.Proto,
+			Scheme:           requestScheme(req),
+			Status:           status,
+			RequestID:        requestID,
+			RequestLine:      requestLine,
+			PayloadSize:      int(bytesRead),
+			PayloadHash:      hexHash,
+			RawHash:          rawHexHash,
+			ContentEncoding:  contentEncoding,
+			Decompressed:     wire != nil && (nil == readErr || errors.Is(readErr, io.EOF)),
+			PrefixHashed:     hashPrefix > 0 && bytesRead > int64(hashPrefix),
+			ParallelHashed:   parallelHashed,
+			Truncated:        truncated,
+			Reset:            reset,
+			Frames:           frames,
+			SchemaErrors:     schemaErrors,
+			MatchedRule:      matchedRule,
+			UserAgent:        req.UserAgent(),
+			Headers:          recordHeaders(req),
+			HeaderHash:       headerHash(req),
+			HeaderCount:      headerCount(req),
+			DuplicateHeaders: duplicateHeaders(req),
+			HeaderBytes:      headerSize(req),
+			JWTClaims:        claims,
+			PathParams:       params,
+			ReadMode:         readMode,
+			ReadDuration:     readDuration,
+			HashDuration:     hashDuration,
+			IsText:           profile.isText(),
+			LineCount:        profile.lines(),
+			Entropy:          profile.entropy(),
+			DelayApplied:     applied,
+			Payload:          string(payload),
+			Form:             form,
+			GoroutineID:      goroutineID(),
+		}
+		if sampled() {
+			recordCall(req, call)
+		}
+
+		// a copy from another putter isn't sent on, or two instances mirroring each other would loop
+		if mirrorURL != "" && req.Header.Get("X-Putter-Mirror-Method") == "" {
+			// payload belongs to the pooled buffer, which goes back to the pool when this handler returns
+			mirrors.send(mirrorCopy{
+				uri:         req.URL.RequestURI(),
+				method:      req.Method,
+				contentType: req.Header.Get("Content-Type"),
+				requestID:   requestID,
+				payload:     bytes.Clone(payload),
+			})
+		}
+
+		if reset {
+			closeConnection(resp, true)
+			return
+		}
+		if applied > 0 {
+			resp.Header().Set("Server-Timing", fmt.Sprintf("putter;dur=%g", float64(applied)/float64(time.Millisecond)))
+		}
+		// constant overhead that every response pays, unlike the chance based stall below
+		time.Sleep(latency)
+		if burnFor > 0 {
+			burnCPU(burnFor, req.Context().Done())
+		}
+		if !holds.wait(req.Context().Done()) {
+			fmt.Fprintln(os.Stderr, "request", requestID, "released before its holdUntil batch filled")
+		}
+		bodyHasher := sha256.New()
+		if respTrailerHash {
+			// declared up front so net/http sends the body chunked and the hash after it
+			resp.Header().Set("Trailer", "X-Body-Hash")
+		}
+		errLine := ""
+		if nil != readErr && !errors.Is(readErr, io.EOF) {
+			if hideErrors {
+				errLine = "internal error\n"
+			} else {
+				errLine = readErr.Error() + "\n"
+			}
+		}
+		padTo := respSize
+		setFromQueryParam(req.URL.Query().Get("respSize"), &padTo)
+		if padTo > respSize && padTo > maxRespSize {
+			padTo = max(respSize, maxRespSize)
+		}
+		if isKeepAlive10 && echoConnection && !noKeepAlive && !truncated && !respTrailerHash && status != 204 && status != 304 {
+			// trickled or large bodies have no length net/http knows of, and an HTTP/1.0 body without
+			// one can only end by closing the connection
+			resp.Header().Set("Content-Length", strconv.Itoa(len(errLine)+max(len(message), padTo)))
+		}
+		if status != 200 {
+			resp.WriteHeader(status)
+		}
+		var body io.Writer = resp
+		if trickleBytes > 0 {
+			body = trickleWriter{resp: resp, done: req.Context().Done(), chunk: trickleBytes, pause: trickleInterval}
+		}
+		if respTrailerHash {
+			body = io.MultiWriter(body, bodyHasher)
+		}
+		io.WriteString(body, errLine)
+		if truncated {
+			// send the first half, make sure it's on the wire, then hang up before the body is complete
+			writePadded(&cutOffWriter{w: body, left: max(len(message), padTo) / 2}, message, padTo)
+			if flusher, canFlush := resp.(http.Flusher); canFlush {
+				flusher.Flush()
 			}
+			closeConnection(resp, false)
+			return
+		}
+		writePadded(body, message, padTo)
+		if respTrailerHash {
+			resp.Header().Set("X-Body-Hash", hex.EncodeToString(bodyHasher.Sum(nil)))
 		}
+
+		// stall response close after writing response
+		time.Sleep(stall)
 	}
 }
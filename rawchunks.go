@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chunk is one piece of a chunked body as sent, recorded by -raw-chunks
+type chunk struct {
+	Size int `json:"size"`
+	// everything after the ; on the chunk size line, e.g. name=value;other
+	Extensions string `json:"extensions,omitempty"`
+}
+
+// chunk size lines are a hex number and some extensions, anything this long is not a chunk size line
+const maxChunkLine = 4096
+
+// recordRawChunks takes over the connection of a chunked request to read the framing net/http
+// would otherwise strip, recording every chunk's size and extensions along with the usual hash.
+// Having hijacked the connection it answers by hand and closes it, so rules, scripts and faults
+// don't apply to these requests.
+func recordRawChunks(resp http.ResponseWriter, req *http.Request, requestID, requestLine string) {
+	hijacker, canHijack := resp.(http.Hijacker)
+	if !canHijack {
+		resp.WriteHeader(500)
+		fmt.Fprintln(resp, "-raw-chunks needs an HTTP/1.x connection")
+		return
+	}
+	conn, bufrw, hijackErr := hijacker.Hijack()
+	if nil != hijackErr {
+		fmt.Fprintln(os.Stderr, hijackErr)
+		return
+	}
+	defer conn.Close()
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		// net/http only sends this when the body is read through it
+		io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+	}
+	hasher := sha256.New()
+	var payload strings.Builder
+	var profile bodyProfile
+	hashTo := io.MultiWriter(hasher, &profile)
+	if storePayload {
+		hashTo = io.MultiWriter(hasher, &profile, &payload)
+	}
+	readStart := time.Now()
+	chunks, size, readErr := readChunks(bufrw.Reader, hashTo)
+	readDuration := time.Since(readStart)
+	status, message := 200, req.URL.Path+" received\n"
+	if nil != readErr {
+		status, message = 400, "Bad chunked body: "+readErr.Error()+"\n"
+		if hideErrors {
+			message = "internal error\n"
+		}
+		fmt.Fprintln(os.Stderr, "raw chunks:", readErr)
+	}
+	call := requestRecord{
+		Timestamp:        time.Now(),
+		Method:           req.Method,
+		Uri:              req.URL.RequestURI(),
+		Proto:            req.Proto,
+		Scheme:           requestScheme(req),
+		Status:           status,
+		RequestID:        requestID,
+		RequestLine:      requestLine,
+		PayloadSize:      size,
+		PayloadHash:      hex.EncodeToString(truncateDigest(hasher.Sum(nil))),
+		Payload:          payload.String(),
+		UserAgent:        req.UserAgent(),
+		Headers:          recordHeaders(req),
+		HeaderHash:       headerHash(req),
+		HeaderCount:      headerCount(req),
+		DuplicateHeaders: duplicateHeaders(req),
+		HeaderBytes:      headerSize(req),
+		ReadMode:         "raw chunks",
+		ReadDuration:     readDuration,
+		IsText:           profile.isText(),
+		LineCount:        profile.lines(),
+		Entropy:          profile.entropy(),
+		Chunks:           chunks,
+		GoroutineID:      goroutineID(),
+	}
+	if sampled() {
+		recordCall(req, call)
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nX-Request-ID: %s\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(message), requestID, message)
+}
+
+// readChunks decodes a chunked body from r into w, returning its chunks, the terminating zero
+// sized one included, and the decoded size. Trailers are read past and dropped.
+func readChunks(r *bufio.Reader, w io.Writer) ([]chunk, int, error) {
+	var chunks []chunk
+	size := 0
+	for {
+		line, lineErr := readChunkLine(r)
+		if nil != lineErr {
+			return chunks, size, lineErr
+		}
+		sizeField, extensions, _ := strings.Cut(line, ";")
+		chunkSize, sizeErr := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 32)
+		if nil != sizeErr || chunkSize < 0 {
+			return chunks, size, errors.New("invalid chunk size " + strconv.Quote(sizeField))
+		}
+		chunks = append(chunks, chunk{Size: int(chunkSize), Extensions: strings.TrimSpace(extensions)})
+		if chunkSize == 0 {
+			break
+		}
+		copied, copyErr := io.CopyN(w, r, chunkSize)
+		size += int(copied)
+		if nil != copyErr {
+			return chunks, size, copyErr
+		}
+		if end, endErr := readChunkLine(r); nil != endErr || end != "" {
+			return chunks, size, errors.New("chunk data longer than its size")
+		}
+	}
+	for {
+		trailer, trailerErr := readChunkLine(r)
+		if nil != trailerErr || trailer == "" {
+			return chunks, size, trailerErr
+		}
+	}
+}
+
+// readChunkLine reads a CRLF terminated line, without the line ending
+func readChunkLine(r *bufio.Reader) (string, error) {
+	line, readErr := r.ReadSlice('\n')
+	if errors.Is(readErr, bufio.ErrBufferFull) || len(line) > maxChunkLine {
+		return "", errors.New("chunk line too long")
+	}
+	if nil != readErr {
+		return "", readErr
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
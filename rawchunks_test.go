@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRawChunks(t *testing.T) {
+	fresh(t)
+	set(t, &rawChunks, true)
+	set(t, &storePayload, true)
+	server := newServer(t)
+	conn, dialErr := net.Dial("tcp", server.Listener.Addr().String())
+	if nil != dialErr {
+		t.Fatal(dialErr)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "POST /chunked HTTP/1.1\r\nHost: putter\r\nTransfer-Encoding: chunked\r\nX-Request-ID: raw\r\n\r\n"+
+		"5;name=value\r\nhello\r\n"+
+		"7 ; first ; second=\"quoted\"\r\n, world\r\n"+
+		"0;last\r\nX-Checksum: abc\r\n\r\n")
+	resp, readErr := http.ReadResponse(bufio.NewReader(conn), nil)
+	if nil != readErr {
+		t.Fatal(readErr)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "/chunked received\n" || resp.Header.Get("X-Request-ID") != "raw" || !resp.Close {
+		t.Errorf("the chunked request answered %d %q with %v", resp.StatusCode, body, resp.Header)
+	}
+	call := recorded(t, 1)[0]
+	want := []chunk{{5, "name=value"}, {7, `first ; second="quoted"`}, {0, "last"}}
+	if !slices.Equal(call.Chunks, want) {
+		t.Error("recorded chunks", call.Chunks, "expected", want)
+	}
+	if call.PayloadHash != hashOf("hello, world") || call.PayloadSize != 12 || call.Payload != "hello, world" || call.ReadMode != "raw chunks" {
+		t.Error("the decoded payload was recorded as", call)
+	}
+}
+
+func TestRawChunksHideErrors(t *testing.T) {
+	for _, hide := range []bool{false, true} {
+		fresh(t)
+		set(t, &rawChunks, true)
+		set(t, &hideErrors, hide)
+		server := newServer(t)
+		conn, dialErr := net.Dial("tcp", server.Listener.Addr().String())
+		if nil != dialErr {
+			t.Fatal(dialErr)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		stderr := captureStderr(t)
+		io.WriteString(conn, "POST /bad HTTP/1.1\r\nHost: putter\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n")
+		resp, readErr := http.ReadResponse(bufio.NewReader(conn), nil)
+		if nil != readErr {
+			t.Fatal(readErr)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		want := "Bad chunked body: invalid chunk size \"zz\"\n"
+		if hide {
+			want = "internal error\n"
+		}
+		if resp.StatusCode != 400 || string(body) != want {
+			t.Errorf("-hide-errors=%t answered %d %q", hide, resp.StatusCode, body)
+		}
+		// the details still reach stderr either way
+		if logged := stderr(); !strings.Contains(logged, `invalid chunk size "zz"`) {
+			t.Errorf("-hide-errors=%t logged %q", hide, logged)
+		}
+		if call := recorded(t, 1)[0]; call.Status != 400 {
+			t.Error("the bad chunked body was recorded as", call)
+		}
+	}
+}
+
+func TestReadChunksRejects(t *testing.T) {
+	for _, test := range []struct {
+		body, problem string
+	}{
+		{"zz\r\n", `invalid chunk size "zz"`},
+		{"3\r\nhello\r\n0\r\n\r\n", "chunk data longer than its size"},
+		{strings.Repeat("0", maxChunkLine+1) + "\r\n", "chunk line too long"},
+		{"5\r\nhel", "EOF"},
+	} {
+		_, _, readErr := readChunks(bufio.NewReaderSize(strings.NewReader(test.body), 2*maxChunkLine), io.Discard)
+		if nil == readErr || !strings.Contains(readErr.Error(), test.problem) {
+			t.Errorf("%q gave %v, expected %q", test.body, readErr, test.problem)
+		}
+	}
+}
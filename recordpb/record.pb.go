@@ -0,0 +1,385 @@
+// Wire format of ?format=protobuf on /recordedRequests: each record is a RequestRecord written
+// as a varint length followed by the message, the same framing as protodelim and Java's
+// writeDelimitedTo. recordpb/record.pb.go is generated from this file, run go generate after
+// changing it.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: record.proto
+
+package recordpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Header struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value         string                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Header) Reset() {
+	*x = Header{}
+	mi := &file_record_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Header) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Header) ProtoMessage() {}
+
+func (x *Header) ProtoReflect() protoreflect.Message {
+	mi := &file_record_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Header.ProtoReflect.Descriptor instead.
+func (*Header) Descriptor() ([]byte, []int) {
+	return file_record_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Header) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Header) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+type RequestRecord struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Seq               int64                  `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	TimestampUnixNano int64                  `protobuf:"varint,2,opt,name=timestamp_unix_nano,json=timestampUnixNano,proto3" json:"timestamp_unix_nano,omitempty"`
+	Method            string                 `protobuf:"bytes,3,opt,name=method,proto3" json:"method,omitempty"`
+	Uri               string                 `protobuf:"bytes,4,opt,name=uri,proto3" json:"uri,omitempty"`
+	Proto             string                 `protobuf:"bytes,5,opt,name=proto,proto3" json:"proto,omitempty"`
+	Status            int32                  `protobuf:"varint,6,opt,name=status,proto3" json:"status,omitempty"`
+	RequestId         string                 `protobuf:"bytes,7,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	PayloadSize       int64                  `protobuf:"varint,8,opt,name=payload_size,json=payloadSize,proto3" json:"payload_size,omitempty"`
+	PayloadHash       string                 `protobuf:"bytes,9,opt,name=payload_hash,json=payloadHash,proto3" json:"payload_hash,omitempty"`
+	RawHash           string                 `protobuf:"bytes,10,opt,name=raw_hash,json=rawHash,proto3" json:"raw_hash,omitempty"`
+	Payload           []byte                 `protobuf:"bytes,11,opt,name=payload,proto3" json:"payload,omitempty"`
+	InterArrivalNanos int64                  `protobuf:"varint,12,opt,name=inter_arrival_nanos,json=interArrivalNanos,proto3" json:"inter_arrival_nanos,omitempty"`
+	Rejected          string                 `protobuf:"bytes,13,opt,name=rejected,proto3" json:"rejected,omitempty"`
+	ReadMode          string                 `protobuf:"bytes,14,opt,name=read_mode,json=readMode,proto3" json:"read_mode,omitempty"`
+	HeaderBytes       int64                  `protobuf:"varint,15,opt,name=header_bytes,json=headerBytes,proto3" json:"header_bytes,omitempty"`
+	UserAgent         string                 `protobuf:"bytes,16,opt,name=user_agent,json=userAgent,proto3" json:"user_agent,omitempty"`
+	Scheme            string                 `protobuf:"bytes,17,opt,name=scheme,proto3" json:"scheme,omitempty"`
+	DelayAppliedNanos int64                  `protobuf:"varint,18,opt,name=delay_applied_nanos,json=delayAppliedNanos,proto3" json:"delay_applied_nanos,omitempty"`
+	IsText            bool                   `protobuf:"varint,19,opt,name=is_text,json=isText,proto3" json:"is_text,omitempty"`
+	Entropy           float64                `protobuf:"fixed64,20,opt,name=entropy,proto3" json:"entropy,omitempty"`
+	Headers           []*Header              `protobuf:"bytes,21,rep,name=headers,proto3" json:"headers,omitempty"`
+	OriginalUri       string                 `protobuf:"bytes,22,opt,name=original_uri,json=originalUri,proto3" json:"original_uri,omitempty"`
+	MatchedRule       string                 `protobuf:"bytes,23,opt,name=matched_rule,json=matchedRule,proto3" json:"matched_rule,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *RequestRecord) Reset() {
+	*x = RequestRecord{}
+	mi := &file_record_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RequestRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RequestRecord) ProtoMessage() {}
+
+func (x *RequestRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_record_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RequestRecord.ProtoReflect.Descriptor instead.
+func (*RequestRecord) Descriptor() ([]byte, []int) {
+	return file_record_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *RequestRecord) GetSeq() int64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *RequestRecord) GetTimestampUnixNano() int64 {
+	if x != nil {
+		return x.TimestampUnixNano
+	}
+	return 0
+}
+
+func (x *RequestRecord) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetUri() string {
+	if x != nil {
+		return x.Uri
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetProto() string {
+	if x != nil {
+		return x.Proto
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetStatus() int32 {
+	if x != nil {
+		return x.Status
+	}
+	return 0
+}
+
+func (x *RequestRecord) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetPayloadSize() int64 {
+	if x != nil {
+		return x.PayloadSize
+	}
+	return 0
+}
+
+func (x *RequestRecord) GetPayloadHash() string {
+	if x != nil {
+		return x.PayloadHash
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetRawHash() string {
+	if x != nil {
+		return x.RawHash
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *RequestRecord) GetInterArrivalNanos() int64 {
+	if x != nil {
+		return x.InterArrivalNanos
+	}
+	return 0
+}
+
+func (x *RequestRecord) GetRejected() string {
+	if x != nil {
+		return x.Rejected
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetReadMode() string {
+	if x != nil {
+		return x.ReadMode
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetHeaderBytes() int64 {
+	if x != nil {
+		return x.HeaderBytes
+	}
+	return 0
+}
+
+func (x *RequestRecord) GetUserAgent() string {
+	if x != nil {
+		return x.UserAgent
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetScheme() string {
+	if x != nil {
+		return x.Scheme
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetDelayAppliedNanos() int64 {
+	if x != nil {
+		return x.DelayAppliedNanos
+	}
+	return 0
+}
+
+func (x *RequestRecord) GetIsText() bool {
+	if x != nil {
+		return x.IsText
+	}
+	return false
+}
+
+func (x *RequestRecord) GetEntropy() float64 {
+	if x != nil {
+		return x.Entropy
+	}
+	return 0
+}
+
+func (x *RequestRecord) GetHeaders() []*Header {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *RequestRecord) GetOriginalUri() string {
+	if x != nil {
+		return x.OriginalUri
+	}
+	return ""
+}
+
+func (x *RequestRecord) GetMatchedRule() string {
+	if x != nil {
+		return x.MatchedRule
+	}
+	return ""
+}
+
+var File_record_proto protoreflect.FileDescriptor
+
+const file_record_proto_rawDesc = "" +
+	"\n" +
+	"\frecord.proto\x12\x06putter\"2\n" +
+	"\x06Header\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value\"\xd9\x05\n" +
+	"\rRequestRecord\x12\x10\n" +
+	"\x03seq\x18\x01 \x01(\x03R\x03seq\x12.\n" +
+	"\x13timestamp_unix_nano\x18\x02 \x01(\x03R\x11timestampUnixNano\x12\x16\n" +
+	"\x06method\x18\x03 \x01(\tR\x06method\x12\x10\n" +
+	"\x03uri\x18\x04 \x01(\tR\x03uri\x12\x14\n" +
+	"\x05proto\x18\x05 \x01(\tR\x05proto\x12\x16\n" +
+	"\x06status\x18\x06 \x01(\x05R\x06status\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\a \x01(\tR\trequestId\x12!\n" +
+	"\fpayload_size\x18\b \x01(\x03R\vpayloadSize\x12!\n" +
+	"\fpayload_hash\x18\t \x01(\tR\vpayloadHash\x12\x19\n" +
+	"\braw_hash\x18\n" +
+	" \x01(\tR\arawHash\x12\x18\n" +
+	"\apayload\x18\v \x01(\fR\apayload\x12.\n" +
+	"\x13inter_arrival_nanos\x18\f \x01(\x03R\x11interArrivalNanos\x12\x1a\n" +
+	"\brejected\x18\r \x01(\tR\brejected\x12\x1b\n" +
+	"\tread_mode\x18\x0e \x01(\tR\breadMode\x12!\n" +
+	"\fheader_bytes\x18\x0f \x01(\x03R\vheaderBytes\x12\x1d\n" +
+	"\n" +
+	"user_agent\x18\x10 \x01(\tR\tuserAgent\x12\x16\n" +
+	"\x06scheme\x18\x11 \x01(\tR\x06scheme\x12.\n" +
+	"\x13delay_applied_nanos\x18\x12 \x01(\x03R\x11delayAppliedNanos\x12\x17\n" +
+	"\ais_text\x18\x13 \x01(\bR\x06isText\x12\x18\n" +
+	"\aentropy\x18\x14 \x01(\x01R\aentropy\x12(\n" +
+	"\aheaders\x18\x15 \x03(\v2\x0e.putter.HeaderR\aheaders\x12!\n" +
+	"\foriginal_uri\x18\x16 \x01(\tR\voriginalUri\x12!\n" +
+	"\fmatched_rule\x18\x17 \x01(\tR\vmatchedRuleB'Z%github.com/superflaco/putter/recordpbb\x06proto3"
+
+var (
+	file_record_proto_rawDescOnce sync.Once
+	file_record_proto_rawDescData []byte
+)
+
+func file_record_proto_rawDescGZIP() []byte {
+	file_record_proto_rawDescOnce.Do(func() {
+		file_record_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_record_proto_rawDesc), len(file_record_proto_rawDesc)))
+	})
+	return file_record_proto_rawDescData
+}
+
+var file_record_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_record_proto_goTypes = []any{
+	(*Header)(nil),        // 0: putter.Header
+	(*RequestRecord)(nil), // 1: putter.RequestRecord
+}
+var file_record_proto_depIdxs = []int32{
+	0, // 0: putter.RequestRecord.headers:type_name -> putter.Header
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_record_proto_init() }
+func file_record_proto_init() {
+	if File_record_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_record_proto_rawDesc), len(file_record_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_record_proto_goTypes,
+		DependencyIndexes: file_record_proto_depIdxs,
+		MessageInfos:      file_record_proto_msgTypes,
+	}.Build()
+	File_record_proto = out.File
+	file_record_proto_goTypes = nil
+	file_record_proto_depIdxs = nil
+}
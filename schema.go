@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// jsonSchema is a compiled -schema. Validation is full JSON Schema, $ref, allOf/anyOf/oneOf and
+// the rest included, and format is asserted rather than treated as a note.
+type jsonSchema struct {
+	schema *jsonschema.Schema
+}
+
+// loadSchema compiles the schema file up front so a bad one fails at startup. $refs to other
+// files resolve relative to it.
+func loadSchema(schemaFile string) (*jsonSchema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat()
+	schema, compileErr := compiler.Compile(schemaFile)
+	if nil != compileErr {
+		return nil, compileErr
+	}
+	return &jsonSchema{schema}, nil
+}
+
+// validate returns a description of every way payload breaks the schema, each prefixed with the
+// JSON pointer of the offending value, or nothing when it conforms
+func (s *jsonSchema) validate(payload []byte) []string {
+	document, unmarshalErr := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if nil != unmarshalErr {
+		return []string{"invalid JSON: " + unmarshalErr.Error()}
+	}
+	validateErr := s.schema.Validate(document)
+	if nil == validateErr {
+		return nil
+	}
+	var failed *jsonschema.ValidationError
+	if !errors.As(validateErr, &failed) {
+		return []string{validateErr.Error()}
+	}
+	var problems []string
+	collectProblems(failed.DetailedOutput(), &problems)
+	// sorted by where they are so the same body always reports its problems in the same order
+	slices.SortStableFunc(problems, func(a, b string) int {
+		whereA, _, _ := strings.Cut(a, ": ")
+		whereB, _, _ := strings.Cut(b, ": ")
+		return strings.Compare(whereA, whereB)
+	})
+	return problems
+}
+
+// collectProblems keeps just the leaves of the output, the "validation failed" units above them
+// say nothing the leaves don't
+func collectProblems(unit *jsonschema.OutputUnit, problems *[]string) {
+	if len(unit.Errors) == 0 {
+		if nil != unit.Error {
+			where := unit.InstanceLocation
+			if where == "" {
+				where = "(root)"
+			}
+			*problems = append(*problems, where+": "+unit.Error.String())
+		}
+		return
+	}
+	for i := range unit.Errors {
+		collectProblems(&unit.Errors[i], problems)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "items"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^ord-[0-9]+$"},
+		"email": {"type": "string", "format": "email"},
+		"priority": {"enum": ["low", "high"]},
+		"items": {"type": "array", "minItems": 1, "items": {"$ref": "#/$defs/item"}}
+	},
+	"$defs": {
+		"item": {
+			"type": "object",
+			"required": ["sku"],
+			"properties": {
+				"sku": {"type": "string", "minLength": 3},
+				"quantity": {"type": "integer", "minimum": 1, "exclusiveMaximum": 10}
+			}
+		}
+	}
+}`
+
+func TestSchemaValidation(t *testing.T) {
+	schema, schemaErr := loadSchema(writeFile(t, "order.json", orderSchema))
+	if nil != schemaErr {
+		t.Fatal(schemaErr)
+	}
+	for _, test := range []struct {
+		document string
+		want     []string
+	}{
+		{`{"id": "ord-1", "priority": "high", "items": [{"sku": "abc", "quantity": 2}]}`, nil},
+		{`[]`, []string{"(root): got array, want object"}},
+		{`{"id": "order", "items": [], "extra": true}`, []string{
+			"(root): additional properties 'extra' not allowed",
+			"/id: 'order' does not match pattern '^ord-[0-9]+$'",
+			"/items: minItems: got 0, want 1",
+		}},
+		// reached through $ref, with exclusiveMaximum and format, none of which the subset this replaced knew
+		{`{"items": [{"sku": "ab", "quantity": 2.5}, {"quantity": 10}], "priority": "urgent", "email": "nobody"}`, []string{
+			"(root): missing property 'id'",
+			"/email: 'nobody' is not valid email: missing @",
+			"/items/0/quantity: got number, want integer",
+			"/items/0/sku: minLength: got 2, want 3",
+			"/items/1: missing property 'sku'",
+			"/items/1/quantity: exclusiveMaximum: got 10, want 10",
+			"/priority: value must be one of 'low', 'high'",
+		}},
+	} {
+		if problems := schema.validate([]byte(test.document)); !slices.Equal(problems, test.want) {
+			t.Errorf("%s gave\n%q\nexpected\n%q", test.document, problems, test.want)
+		}
+	}
+
+	if _, patternErr := loadSchema(writeFile(t, "bad.json", `{"properties": {"id": {"pattern": "("}}}`)); nil == patternErr {
+		t.Error("a schema with a bad pattern loaded")
+	}
+	if _, refErr := loadSchema(writeFile(t, "dangling.json", `{"$ref": "#/$defs/missing"}`)); nil == refErr {
+		t.Error("a schema with a dangling $ref loaded")
+	}
+}
+
+func TestSchemaRejectsRequests(t *testing.T) {
+	fresh(t)
+	schema, _ := loadSchema(writeFile(t, "order.json", orderSchema))
+	set(t, &requestSchema, schema)
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return serve(req)
+	}
+	if resp := post(`{"id": "ord-7", "items": [{"sku": "abc"}]}`); resp.Code != 200 {
+		t.Error("a valid order answered", resp.Code, resp.Body)
+	}
+	resp := post(`{"id": "ord-7", "items": []}`)
+	if resp.Code != 422 || !strings.Contains(resp.Body.String(), "/items: minItems: got 0, want 1") {
+		t.Error("an invalid order answered", resp.Code, resp.Body)
+	}
+	if resp = post(`{"id": `); resp.Code != 422 {
+		t.Error("malformed JSON answered", resp.Code)
+	}
+	calls := recorded(t, 3)
+	if len(calls[2].SchemaErrors) != 0 || calls[2].Status != 200 {
+		t.Error("the valid order was recorded as", calls[2])
+	}
+	if !slices.Equal(calls[1].SchemaErrors, []string{"/items: minItems: got 0, want 1"}) || calls[1].Status != 422 {
+		t.Error("the invalid order was recorded as", calls[1])
+	}
+	if len(calls[0].SchemaErrors) != 1 || !strings.HasPrefix(calls[0].SchemaErrors[0], "invalid JSON: ") {
+		t.Error("malformed JSON was recorded with", calls[0].SchemaErrors)
+	}
+}